@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+func runCreate(args []string) int {
+	fs := newFlagSet("create", "<file|dir>")
+	var trackers, webSeeds stringsFlag
+	fs.Var(&trackers, "a", "tracker URL, repeat for more tiers and separate URLs of the same tier with commas")
+	fs.Var(&webSeeds, "w", "web seed URL, may be repeated")
+	out := fs.String("o", "", "path of the .torrent file to write, defaults to <name>.torrent")
+	comment := fs.String("c", "", "comment")
+	createdBy := fs.String("created-by", "mytorrent", "name of the program creating the torrent")
+	noDate := fs.Bool("no-date", false, "leave the creation date out")
+	private := fs.Bool("private", false, "only get peers from the trackers of the torrent")
+	var pieceLength byteSize
+	fs.Var(&pieceLength, "piece-length", "piece length, e.g. 256K, picked from the content size by default")
+	if code, ok := parseFlags(fs, args, 1, 1); !ok {
+		return code
+	}
+
+	opts := torrent.CreateOptions{
+		WebSeeds:    webSeeds,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		PieceLength: int(pieceLength),
+	}
+	for _, tier := range trackers {
+		opts.Trackers = append(opts.Trackers, strings.Split(tier, ","))
+	}
+	if *noDate {
+		opts.CreationDate = time.Unix(-1, 0)
+	}
+
+	td, err := torrent.CreateTorrent(fs.Arg(0), opts)
+	if err != nil {
+		return fail(err)
+	}
+
+	path := *out
+	if path == "" {
+		path = td.Info.Name + ".torrent"
+	}
+
+	encoded, err := td.Encode()
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.WriteFile(path, []byte(encoded), 0644); err != nil {
+		return fail(err)
+	}
+
+	return exitOK
+}
+
+// stringsFlag is a flag value collecting every occurrence of the flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
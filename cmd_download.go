@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+func runDownload(args []string) int {
+	fs := newFlagSet("download", "<torrent file>...")
+	var sf sessionFlags
+	sf.register(fs)
+	outDir := fs.String("o", ".", "directory to save the downloaded content to")
+	seed := fs.Bool("seed", false, "keep uploading once the downloads complete, until interrupted")
+	var files fileIndexes
+	fs.Var(&files, "files", "indexes of the files to download as listed by info, e.g. 0,3-5, the others are skipped")
+	if code, ok := parseFlags(fs, args, 1, -1); !ok {
+		return code
+	}
+
+	var tds []*torrent.TorrentData
+	for _, arg := range fs.Args() {
+		// Out of scope: magnet links need the metadata exchange with peers
+		// (BEP 9), which isn't implemented
+		if strings.HasPrefix(arg, "magnet:") {
+			return fail(errors.New("magnet links aren't supported, download the .torrent file instead"))
+		}
+
+		td, err := readTorrentFile(arg)
+		if err != nil {
+			return fail(err)
+		}
+		tds = append(tds, td)
+	}
+
+	cfg := sf.config(*outDir)
+	cfg.Seed = *seed
+
+	client, err := sf.client()
+	if err != nil {
+		return fail(err)
+	}
+
+	session, err := torrent.NewSession(client, cfg)
+	if err != nil {
+		return fail(err)
+	}
+	defer session.Close()
+
+	if err := sf.serve(session); err != nil {
+		return fail(err)
+	}
+
+	torrents := make([]*torrent.Torrent, 0, len(tds))
+	for _, td := range tds {
+		var opts torrent.AddOptions
+		if files != nil {
+			if opts.FilePriorities, err = selectFiles(td.Info, files); err != nil {
+				return fail(err)
+			}
+		}
+
+		t, err := session.AddTorrentDataWith(td, opts)
+		if err != nil {
+			return fail(err)
+		}
+		torrents = append(torrents, t)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := watch(ctx, torrents, !*seed); err != nil {
+		if *seed && errors.Is(err, context.Canceled) {
+			return exitOK
+		}
+		return exitCode(err)
+	}
+
+	return exitOK
+}
+
+// selectFiles returns priorities skipping every file of the torrent but those
+// at indexes, numbered like the info command does.
+func selectFiles(info *torrent.TorrentInfo, indexes []int) ([]torrent.FilePriority, error) {
+	n := 0
+	switch {
+	case !info.HasV1():
+		n = len(info.FileTree)
+	case info.Files == nil:
+		n = 1
+	default:
+		for _, f := range info.Files {
+			if !strings.Contains(f.Attr, "p") {
+				n++
+			}
+		}
+	}
+
+	priorities := make([]torrent.FilePriority, n)
+	for _, idx := range indexes {
+		if idx >= n {
+			return nil, fmt.Errorf("%s has no file %d", info.Name, idx)
+		}
+		priorities[idx] = torrent.FileNormal
+	}
+	return priorities, nil
+}
+
+// errTorrentFailed is returned by watch when a torrent stopped with an
+// error.
+var errTorrentFailed = errors.New("torrent failed")
+
+// watch renders the progress of torrents once a second. When untilDone is
+// set it returns once every torrent stopped, otherwise it runs until ctx is
+// cancelled.
+func watch(ctx context.Context, torrents []*torrent.Torrent, untilDone bool) error {
+	display := &progressDisplay{w: os.Stdout}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		display.render(torrents)
+
+		finished := true
+		failed := 0
+		for _, t := range torrents {
+			switch t.State() {
+			case torrent.StateCompleted, torrent.StateSeeding:
+			case torrent.StateError:
+				failed++
+			default:
+				finished = false
+			}
+		}
+		if failed == len(torrents) || (untilDone && finished) {
+			if failed > 0 {
+				return errTorrentFailed
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupted
+	}
+	return exitFailure
+}
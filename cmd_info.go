@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runInfo(args []string) int {
+	fs := newFlagSet("info", "<torrent>")
+	if code, ok := parseFlags(fs, args, 1, 1); !ok {
+		return code
+	}
+
+	td, err := readTorrentFile(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+
+	info := td.Info
+	fmt.Printf("Name:         %s\n", info.Name)
+	fmt.Printf("Info hash:    %s\n", td.InfoHash())
+	if v2, ok := td.InfoHashV2(); ok {
+		fmt.Printf("Info hash v2: %s\n", v2)
+	}
+	switch {
+	case info.HasV1() && info.HasV2():
+		fmt.Printf("Version:      hybrid\n")
+	case info.HasV2():
+		fmt.Printf("Version:      v2\n")
+	default:
+		fmt.Printf("Version:      v1\n")
+	}
+	fmt.Printf("Announce:     %s\n", td.Announce)
+	for i, tier := range td.AnnounceList {
+		fmt.Printf("Tier %d:       %s\n", i+1, strings.Join(tier, ", "))
+	}
+	if td.Comment != "" {
+		fmt.Printf("Comment:      %s\n", td.Comment)
+	}
+	if td.CreatedBy != "" {
+		fmt.Printf("Created by:   %s\n", td.CreatedBy)
+	}
+	if td.CreationDate != 0 {
+		fmt.Printf("Created:      %s\n", time.Unix(td.CreationDate, 0).Format(time.RFC3339))
+	}
+	if td.Encoding != "" {
+		fmt.Printf("Encoding:     %s\n", td.Encoding)
+	}
+	fmt.Printf("Private:      %t\n", info.Private)
+	if info.Source != "" {
+		fmt.Printf("Source:       %s\n", info.Source)
+	}
+	for _, u := range td.URLList {
+		fmt.Printf("Web seed:     %s\n", u)
+	}
+	for _, u := range td.HTTPSeeds {
+		fmt.Printf("HTTP seed:    %s\n", u)
+	}
+	for _, n := range td.Nodes {
+		fmt.Printf("DHT node:     %s:%d\n", n.Host, n.Port)
+	}
+	fmt.Printf("Piece length: %s\n", formatBytes(float64(info.PieceLength)))
+	if info.HasV1() {
+		fmt.Printf("Pieces:       %d\n", len(info.Pieces))
+	}
+	fmt.Printf("Total size:   %s (%d bytes)\n", formatBytes(float64(info.TotalLength())), info.TotalLength())
+
+	switch {
+	case info.HasV2():
+		fmt.Printf("Files:\n")
+		for i, f := range info.FileTree {
+			fmt.Printf("  %3d  %s (%s)\n", i, filepath.Join(f.Path...), formatBytes(float64(f.Length)))
+		}
+	case info.Files != nil:
+		fmt.Printf("Files:\n")
+		// Padding files have no index, see -files of the download command
+		i := 0
+		for _, f := range info.Files {
+			index := "   "
+			if !strings.Contains(f.Attr, "p") {
+				index = fmt.Sprintf("%3d", i)
+				i++
+			}
+			fmt.Printf("  %s  %s (%s)\n", index, filepath.Join(f.Path...), formatBytes(float64(f.Length)))
+		}
+	}
+
+	return exitOK
+}
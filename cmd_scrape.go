@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+func runScrape(args []string) int {
+	fs := newFlagSet("scrape", "<torrent>...")
+	tracker := fs.String("tracker", "", "scrape this tracker instead of the announce URL of each torrent")
+	timeout := fs.Duration("timeout", 30*time.Second, "give up on a tracker after this long")
+	var hf httpFlags
+	hf.register(fs)
+	if code, ok := parseFlags(fs, args, 1, -1); !ok {
+		return code
+	}
+
+	// Ask every tracker once about all of its torrents
+	type entry struct {
+		name string
+		hash torrent.InfoHash
+	}
+	var order []string
+	byTracker := make(map[string][]entry)
+	for _, path := range fs.Args() {
+		td, err := readTorrentFile(path)
+		if err != nil {
+			return fail(fmt.Errorf("%s: %w", path, err))
+		}
+
+		url := *tracker
+		if url == "" {
+			url = td.Announce
+		}
+		if url == "" && len(td.AnnounceList) > 0 && len(td.AnnounceList[0]) > 0 {
+			url = td.AnnounceList[0][0]
+		}
+		if url == "" {
+			return fail(fmt.Errorf("%s: torrent has no tracker", path))
+		}
+
+		if _, ok := byTracker[url]; !ok {
+			order = append(order, url)
+		}
+		byTracker[url] = append(byTracker[url], entry{td.Info.Name, td.InfoHash()})
+	}
+
+	httpCfg, err := hf.config()
+	if err != nil {
+		return fail(err)
+	}
+
+	client := &torrent.Client{HTTP: httpCfg}
+	code := exitOK
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSEEDERS\tLEECHERS\tDOWNLOADED\tTRACKER")
+
+	for _, url := range order {
+		entries := byTracker[url]
+		hashes := make([]torrent.InfoHash, len(entries))
+		for i, e := range entries {
+			hashes[i] = e.hash
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		results, err := client.Scrape(ctx, url, hashes)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mytorrent: %s: %v\n", url, err)
+			code = exitFailure
+			continue
+		}
+
+		for _, e := range entries {
+			r, ok := results[e.hash]
+			if !ok {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", truncate(e.name, 40), url)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", truncate(e.name, 40), r.Seeders, r.Leechers, r.Downloaded, url)
+		}
+	}
+
+	w.Flush()
+
+	return code
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+func runSeed(args []string) int {
+	fs := newFlagSet("seed", "<torrent> <dir>")
+	var sf sessionFlags
+	sf.register(fs)
+	if code, ok := parseFlags(fs, args, 2, 2); !ok {
+		return code
+	}
+
+	td, err := readTorrentFile(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+
+	dir := fs.Arg(1)
+	valid := torrent.VerifyPieces(td, dir)
+	for _, ok := range valid {
+		if !ok {
+			return fail(fmt.Errorf("content of %s in %s is incomplete, run verify for details", td.Info.Name, dir))
+		}
+	}
+
+	cfg := sf.config(dir)
+	cfg.Seed = true
+
+	client, err := sf.client()
+	if err != nil {
+		return fail(err)
+	}
+
+	session, err := torrent.NewSession(client, cfg)
+	if err != nil {
+		return fail(err)
+	}
+	defer session.Close()
+
+	if err := sf.serve(session); err != nil {
+		return fail(err)
+	}
+
+	t, err := session.AddTorrentData(td)
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// Seeding only ends when interrupted
+	err = watch(ctx, []*torrent.Torrent{t}, false)
+	if errors.Is(err, context.Canceled) {
+		return exitOK
+	}
+
+	return exitCode(err)
+}
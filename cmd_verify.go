@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+func runVerify(args []string) int {
+	fs := newFlagSet("verify", "<torrent> <dir>")
+	if code, ok := parseFlags(fs, args, 2, 2); !ok {
+		return code
+	}
+
+	td, err := readTorrentFile(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+
+	valid := torrent.VerifyPieces(td, fs.Arg(1))
+
+	good := 0
+	for _, ok := range valid {
+		if ok {
+			good++
+		}
+	}
+
+	fmt.Printf("%d/%d pieces valid\n", good, len(valid))
+	if good != len(valid) {
+		return exitFailure
+	}
+
+	return exitOK
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+// sessionFlags are the flags shared by the commands that run a session.
+type sessionFlags struct {
+	port         int
+	maxConns     int
+	maxPeers     int
+	maxActive    int
+	downloadRate byteSize
+	uploadRate   byteSize
+	encryption   encryptionPolicy
+	utp          bool
+	lsd          bool
+	hashWorkers  int
+	writeCache   byteSize
+	readCache    byteSize
+	sync         syncPolicy
+	allocation   allocationMode
+	serveAddr    string
+	verbose      bool
+	trace        bool
+	http         httpFlags
+}
+
+func (sf *sessionFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&sf.port, "port", 6881, "port to listen for peers on")
+	fs.IntVar(&sf.maxConns, "max-conns", 200, "maximum number of peer connections, 0 for unlimited")
+	fs.IntVar(&sf.maxPeers, "max-peers", 50, "maximum number of peer connections per torrent, 0 for unlimited")
+	fs.IntVar(&sf.maxActive, "max-active", 5, "maximum number of torrents downloading at once, 0 for unlimited")
+	fs.Var(&sf.downloadRate, "download-rate", "download limit in bytes per second, e.g. 500K or 2M, 0 for unlimited")
+	fs.Var(&sf.uploadRate, "upload-rate", "upload limit in bytes per second, e.g. 500K or 2M, 0 for unlimited")
+	fs.Var(&sf.encryption, "encryption", "encryption of peer connections: prefer, require or disable")
+	fs.BoolVar(&sf.utp, "utp", true, "connect to peers over uTP as well as TCP")
+	fs.BoolVar(&sf.lsd, "lsd", true, "look for peers on the local network")
+	fs.IntVar(&sf.hashWorkers, "hash-workers", 0, "goroutines verifying pieces (0 = one per CPU)")
+	fs.Var(&sf.writeCache, "write-cache", "memory for pieces waiting to be written, e.g. 64M (0 = default)")
+	fs.Var(&sf.readCache, "read-cache", "memory for pieces read to upload them, e.g. 32M (0 = default)")
+	fs.Var(&sf.sync, "sync", "when to flush content to disk: complete, always or never")
+	fs.Var(&sf.allocation, "allocation", "how files take up disk space: sparse or full")
+	fs.StringVar(&sf.serveAddr, "serve", "", "address to serve the content of the torrents over HTTP on, e.g. :8080")
+	fs.BoolVar(&sf.verbose, "v", false, "log to stderr")
+	fs.BoolVar(&sf.trace, "trace", false, "log every peer message to stderr")
+	sf.http.register(fs)
+}
+
+func (sf *sessionFlags) client() (*torrent.Client, error) {
+	httpCfg, err := sf.http.config()
+	if err != nil {
+		return nil, err
+	}
+	c := &torrent.Client{HTTP: httpCfg}
+
+	level := slog.LevelInfo
+	switch {
+	case sf.trace:
+		level = torrent.LevelTrace
+	case sf.verbose:
+		level = slog.LevelDebug
+	default:
+		return c, nil
+	}
+
+	c.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	return c, nil
+}
+
+// serve exposes the content of the torrents of s over HTTP in the
+// background, when asked to.
+func (sf *sessionFlags) serve(s *torrent.Session) error {
+	if sf.serveAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", sf.serveAddr)
+	if err != nil {
+		return err
+	}
+
+	go http.Serve(l, s.HTTPHandler())
+	return nil
+}
+
+func (sf *sessionFlags) config(dataDir string) torrent.SessionConfig {
+	return torrent.SessionConfig{
+		ListenAddr:         fmt.Sprintf(":%d", sf.port),
+		DataDir:            dataDir,
+		MaxConns:           sf.maxConns,
+		MaxConnsPerTorrent: sf.maxPeers,
+		MaxActive:          sf.maxActive,
+		DownloadRate:       int(sf.downloadRate),
+		UploadRate:         int(sf.uploadRate),
+		Encryption:         torrent.EncryptionPolicy(sf.encryption),
+		DisableUTP:         !sf.utp,
+		DisableLSD:         !sf.lsd,
+		HashWorkers:        sf.hashWorkers,
+		WriteCache:         int(sf.writeCache),
+		ReadCache:          int(sf.readCache),
+		Sync:               torrent.SyncPolicy(sf.sync),
+		Allocation:         torrent.AllocationMode(sf.allocation),
+	}
+}
+
+// httpFlags are the flags of the commands talking to trackers.
+type httpFlags struct {
+	timeout   time.Duration
+	proxy     string
+	caFile    string
+	userAgent string
+}
+
+func (hf *httpFlags) register(fs *flag.FlagSet) {
+	fs.DurationVar(&hf.timeout, "tracker-timeout", 30*time.Second, "give up on a tracker request after this long")
+	fs.StringVar(&hf.proxy, "proxy", "", "send HTTP requests through this proxy, defaults to $HTTPS_PROXY and $HTTP_PROXY")
+	fs.StringVar(&hf.caFile, "ca-file", "", "trust the certificates in this PEM file instead of the system ones")
+	fs.StringVar(&hf.userAgent, "user-agent", "", "user agent sent to trackers and web seeds")
+}
+
+func (hf *httpFlags) config() (torrent.HTTPConfig, error) {
+	cfg := torrent.HTTPConfig{
+		Timeout:   hf.timeout,
+		UserAgent: hf.userAgent,
+	}
+
+	if hf.proxy != "" {
+		u, err := url.Parse(hf.proxy)
+		if err != nil || u.Host == "" {
+			return cfg, fmt.Errorf("invalid proxy %q", hf.proxy)
+		}
+		cfg.Proxy = u
+	}
+
+	if hf.caFile != "" {
+		pool, err := torrent.LoadCertPool(hf.caFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// byteSize is a flag value accepting sizes with an optional K, M or G
+// suffix.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// fileIndexes is a flag value accepting comma separated indexes of files and
+// ranges of them, e.g. "0,3-5".
+type fileIndexes []int
+
+func (fi *fileIndexes) String() string {
+	parts := make([]string, len(*fi))
+	for i, idx := range *fi {
+		parts[i] = strconv.Itoa(idx)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (fi *fileIndexes) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(last)
+		}
+		if err != nil || from < 0 || to < from {
+			return fmt.Errorf("invalid file index %q", part)
+		}
+
+		for idx := from; idx <= to; idx++ {
+			*fi = append(*fi, idx)
+		}
+	}
+	return nil
+}
+
+// encryptionPolicy is a flag value accepting the names of the encryption
+// policies.
+type encryptionPolicy torrent.EncryptionPolicy
+
+func (p *encryptionPolicy) String() string {
+	return torrent.EncryptionPolicy(*p).String()
+}
+
+func (p *encryptionPolicy) Set(s string) error {
+	for _, policy := range []torrent.EncryptionPolicy{torrent.EncryptionPrefer, torrent.EncryptionRequire, torrent.EncryptionDisable} {
+		if policy.String() == s {
+			*p = encryptionPolicy(policy)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// syncPolicy is a flag value accepting the names of the sync policies.
+type syncPolicy torrent.SyncPolicy
+
+func (p *syncPolicy) String() string {
+	return torrent.SyncPolicy(*p).String()
+}
+
+func (p *syncPolicy) Set(s string) error {
+	for _, policy := range []torrent.SyncPolicy{torrent.SyncOnComplete, torrent.SyncAlways, torrent.SyncNever} {
+		if policy.String() == s {
+			*p = syncPolicy(policy)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown sync policy %q", s)
+}
+
+// allocationMode is a flag value accepting the names of the allocation
+// modes.
+type allocationMode torrent.AllocationMode
+
+func (m *allocationMode) String() string {
+	return torrent.AllocationMode(*m).String()
+}
+
+func (m *allocationMode) Set(s string) error {
+	for _, mode := range []torrent.AllocationMode{torrent.AllocSparse, torrent.AllocFull} {
+		if mode.String() == s {
+			*m = allocationMode(mode)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown allocation mode %q", s)
+}
+
+// newFlagSet returns a flag set whose usage lists the arguments of the
+// command as well.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: mytorrent %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args and checks the number of positional arguments.
+// It returns the exit code to use when the command must not run.
+func parseFlags(fs *flag.FlagSet, args []string, minArgs, maxArgs int) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+
+	if fs.NArg() < minArgs || (maxArgs >= 0 && fs.NArg() > maxArgs) {
+		fs.Usage()
+		return exitUsage, false
+	}
+
+	return exitOK, true
+}
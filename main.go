@@ -1,61 +1,84 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/joaovictorsl/mytorrent/torrent"
 )
 
+const (
+	exitOK = 0
+	// The command ran but failed, e.g. a download error or invalid data
+	exitFailure = 1
+	// The command line was invalid
+	exitUsage = 2
+	// Stopped by SIGINT
+	exitInterrupted = 130
+)
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"download", "download torrents from .torrent files, magnet links aren't supported", runDownload},
+	{"info", "print the metadata of a .torrent file", runInfo},
+	{"verify", "check downloaded data against a .torrent file", runVerify},
+	{"seed", "upload already downloaded data to other peers", runSeed},
+	{"create", "create a .torrent file from a file or directory", runCreate},
+	{"scrape", "ask trackers how many peers share torrents", runScrape},
+}
+
 func main() {
-	files := []string{
-		// "debian-12.6.0-amd64-netinst.iso.torrent",
-		// "slackware-14.2-source-dvd.torrent",
-		"itsworking.gif.torrent",
-		"codercat.gif.torrent",
-		"sample.torrent",
-	}
-	for _, file := range files {
-		client := &torrent.Client{}
-		f, err := os.Open(file)
-		if err != nil {
-			panic(err)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage()
+		if len(args) == 0 {
+			return exitUsage
 		}
-		defer f.Close()
+		return exitOK
+	}
 
-		if err := client.Download(bufio.NewReader(f)); err != nil {
-			panic(err)
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
 		}
+	}
 
-		assemblyFile(strings.Split(file, ".torrent")[0])
+	fmt.Fprintf(os.Stderr, "mytorrent: unknown command %q\n", args[0])
+	usage()
+	return exitUsage
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: mytorrent <command> [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Run 'mytorrent <command> -h' for the flags of a command.")
 }
 
-func assemblyFile(name string) {
-	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0666)
+// fail prints err and returns the exit code for failures.
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "mytorrent:", err)
+	return exitFailure
+}
+
+func readTorrentFile(path string) (*torrent.TorrentData, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer f.Close()
 
-	begin := int64(0)
-	var b []byte
-	for i := 0; i < 2524; i++ {
-		savePath := fmt.Sprintf("piece_%d", i)
-		b, err = os.ReadFile(savePath)
-		if err != nil {
-			panic(err)
-		}
-
-		n, err := f.WriteAt(b, begin)
-		if err != nil {
-			panic(err)
-		}
-
-		begin += int64(n)
-
-		os.Remove(savePath)
-	}
+	return torrent.ReadTorrentData(f)
 }
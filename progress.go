@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/joaovictorsl/mytorrent/torrent"
+)
+
+// progressDisplay redraws one status line per torrent in place.
+type progressDisplay struct {
+	w     io.Writer
+	lines int
+}
+
+func (d *progressDisplay) render(torrents []*torrent.Torrent) {
+	var b strings.Builder
+	if d.lines > 0 {
+		// Move back to the first line we drew
+		fmt.Fprintf(&b, "\033[%dA", d.lines)
+	}
+
+	for _, t := range torrents {
+		b.WriteString("\r\033[K")
+		b.WriteString(statusLine(t))
+		b.WriteString("\n")
+	}
+
+	d.lines = len(torrents)
+	io.WriteString(d.w, b.String())
+}
+
+func statusLine(t *torrent.Torrent) string {
+	s := t.Stats()
+
+	percent := 100.0
+	if s.BytesWanted > 0 {
+		percent = float64(s.BytesWanted-s.BytesLeft) / float64(s.BytesWanted) * 100
+	}
+
+	line := fmt.Sprintf(
+		"%-30s %6.2f%% %5d/%-5d pieces  down %10s/s  up %10s/s  peers %3d  %s",
+		truncate(t.Name(), 30),
+		percent,
+		s.PiecesDone,
+		s.PiecesTotal,
+		formatBytes(s.DownloadRate),
+		formatBytes(s.UploadRate),
+		s.ConnectedPeers,
+		s.State,
+	)
+
+	if s.HashQueue > 0 {
+		line += fmt.Sprintf("  hashing %d", s.HashQueue)
+	}
+	if s.ETA > 0 {
+		line += "  ETA " + s.ETA.Round(time.Second).String()
+	}
+	if err := t.Err(); err != nil {
+		line += ": " + err.Error()
+	}
+
+	return line
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
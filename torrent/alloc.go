@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AllocationMode tells how the files of a torrent take up disk space.
+// Pieces are always saved in place: compact allocation, which stores them
+// in download order behind a slot map, isn't supported.
+type AllocationMode int
+
+const (
+	// Files are created at their full size up front, without reserving
+	// disk space for the parts not downloaded yet.
+	AllocSparse AllocationMode = iota
+	// Disk space is reserved for the whole files up front, which avoids
+	// fragmentation and running out of space halfway through. On Linux it
+	// is instant, elsewhere files are filled with zeros.
+	AllocFull
+)
+
+func (m AllocationMode) String() string {
+	switch m {
+	case AllocSparse:
+		return "sparse"
+	case AllocFull:
+		return "full"
+	default:
+		return fmt.Sprintf("AllocationMode(%d)", int(m))
+	}
+}
+
+// prepare makes sure there is enough free space for the files at the
+// indexes of wanted, and allocates them.
+func (s *fileStorage) prepare(wanted []bool) error {
+	var needed int64
+	for _, f := range s.files {
+		if f.pad || !wanted[f.index] {
+			continue
+		}
+
+		fi, err := os.Stat(f.path)
+		switch {
+		case os.IsNotExist(err):
+			needed += f.length
+		case err != nil:
+			return err
+		default:
+			needed += max(f.length-allocated(fi), 0)
+		}
+	}
+
+	free, err := freeSpace(s.dir)
+	if err == nil && free < needed {
+		return fmt.Errorf("not enough free space in %s: %d bytes needed, %d available", s.dir, needed, free)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, f := range s.files {
+		if f.pad || !wanted[f.index] || s.isParted(f.index) {
+			continue
+		}
+		if err := s.allocate(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allocate gives the file f the space the allocation mode asks for,
+// creating it. s.mu must be held.
+func (s *fileStorage) allocate(f storageFile) error {
+	// The handle is allocated outside of s.fdMu, every other file stays
+	// available meanwhile
+	h, err := s.open(f, true)
+	if err != nil {
+		return err
+	}
+	defer s.release(h)
+
+	return allocateFile(h.f, f.length, s.allocation)
+}
+
+// allocateFile gives file the space of length bytes mode asks for.
+func allocateFile(file *os.File, length int64, mode AllocationMode) error {
+	switch mode {
+	case AllocSparse:
+		fi, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() < length {
+			return file.Truncate(length)
+		}
+	case AllocFull:
+		return fallocate(file, length)
+	}
+
+	return nil
+}
+
+// zeroFill allocates the space of file up to length by writing zeros past
+// its end.
+func zeroFill(file *os.File, length int64) error {
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, 1<<20)
+	for off := fi.Size(); off < length; off += int64(len(zeros)) {
+		n := min(int64(len(zeros)), length-off)
+		if _, err := file.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// freeSpace returns the bytes available to us on the file system of path,
+// or of its closest existing parent.
+func freeSpace(path string) (int64, error) {
+	for {
+		free, err := statFree(path)
+		if !errors.Is(err, os.ErrNotExist) {
+			return free, err
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,32 @@
+package torrent
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the disk space of file up to length.
+func fallocate(file *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		// File systems without fallocate, like some network ones
+		return zeroFill(file, length)
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: file.Name(), Err: err}
+	}
+	return nil
+}
+
+// allocated returns the disk space taken by the file described by fi.
+func allocated(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return fi.Size()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package torrent
+
+import "os"
+
+// fallocate reserves the disk space of file up to length.
+func fallocate(file *os.File, length int64) error {
+	return zeroFill(file, length)
+}
+
+// allocated returns the disk space taken by the file described by fi.
+func allocated(fi os.FileInfo) int64 {
+	return fi.Size()
+}
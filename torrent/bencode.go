@@ -0,0 +1,174 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Helpers to bencode values by hand. Every helper returns the encoded form,
+// so containers take already encoded elements.
+
+func encodeString(s string) string {
+	return fmt.Sprintf("%d:%s", len(s), s)
+}
+
+func encodeInt(i int64) string {
+	return fmt.Sprintf("i%de", i)
+}
+
+func encodeList(encoded []string) string {
+	return "l" + strings.Join(encoded, "") + "e"
+}
+
+func encodeStringList(list []string) string {
+	encoded := make([]string, len(list))
+	for i, s := range list {
+		encoded[i] = encodeString(s)
+	}
+	return encodeList(encoded)
+}
+
+// encodeValue encodes a value as returned by the decoder, found at field.
+func encodeValue(field string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return encodeString(v), nil
+	case []byte:
+		return encodeString(string(v)), nil
+	case int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case []interface{}:
+		encoded := make([]string, len(v))
+		for i, item := range v {
+			var err error
+			if encoded[i], err = encodeValue(fmt.Sprintf("%s[%d]", field, i), item); err != nil {
+				return "", err
+			}
+		}
+		return encodeList(encoded), nil
+	case map[string]interface{}:
+		encoded := make(map[string]string, len(v))
+		for k, item := range v {
+			var err error
+			if encoded[k], err = encodeValue(field+"."+k, item); err != nil {
+				return "", err
+			}
+		}
+		return encodeDict(encoded), nil
+	default:
+		return "", fieldError(field, ErrWrongType, "cannot bencode %T", v)
+	}
+}
+
+// encodeDict encodes a dictionary whose values are already encoded, sorting
+// the keys as the spec requires.
+func encodeDict(encoded map[string]string) string {
+	keys := make([]string, 0, len(encoded))
+	for k := range encoded {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("d")
+	for _, k := range keys {
+		b.WriteString(encodeString(k))
+		b.WriteString(encoded[k])
+	}
+	b.WriteString("e")
+
+	return b.String()
+}
+
+// rawDictValue returns the exact bytes of the value stored under key in the
+// bencoded dictionary b, as they appear in b.
+func rawDictValue(b []byte, key string) ([]byte, error) {
+	if len(b) == 0 || b[0] != 'd' {
+		return nil, errors.New("not a bencoded dictionary")
+	}
+
+	pos := 1
+	for pos < len(b) && b[pos] != 'e' {
+		k, next, err := readString(b, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := skipValue(b, next)
+		if err != nil {
+			return nil, err
+		}
+
+		if k == key {
+			return b[next:end], nil
+		}
+		pos = end
+	}
+
+	return nil, fmt.Errorf("missing %s", key)
+}
+
+// readString reads the bencoded string starting at b[pos] and returns it
+// along with the offset right after it.
+func readString(b []byte, pos int) (string, int, error) {
+	colon := bytes.IndexByte(b[pos:], ':')
+	if colon <= 0 {
+		return "", 0, fmt.Errorf("invalid string at offset %d", pos)
+	}
+
+	n, err := strconv.Atoi(string(b[pos : pos+colon]))
+	start := pos + colon + 1
+	if err != nil || n < 0 || n > len(b)-start {
+		return "", 0, fmt.Errorf("invalid string length at offset %d", pos)
+	}
+
+	return string(b[start : start+n]), start + n, nil
+}
+
+// skipValue returns the offset right after the bencoded value starting at
+// b[pos]. Nesting is tracked with a counter so deeply nested input cannot
+// exhaust the stack.
+func skipValue(b []byte, pos int) (int, error) {
+	depth := 0
+	for {
+		if pos >= len(b) {
+			return 0, errors.New("unexpected end of bencoded data")
+		}
+
+		switch c := b[pos]; {
+		case c == 'd' || c == 'l':
+			depth++
+			pos++
+		case c == 'e':
+			if depth == 0 {
+				return 0, fmt.Errorf("unexpected end marker at offset %d", pos)
+			}
+			depth--
+			pos++
+		case c == 'i':
+			end := bytes.IndexByte(b[pos:], 'e')
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated integer at offset %d", pos)
+			}
+			pos += end + 1
+		case c >= '0' && c <= '9':
+			_, next, err := readString(b, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		default:
+			return 0, fmt.Errorf("invalid byte %q at offset %d", c, pos)
+		}
+
+		if depth == 0 {
+			return pos, nil
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package torrent
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// How often the peers we upload to are picked again
+	chokeInterval = 10 * time.Second
+	// How often the optimistic unchoke moves to another peer
+	optimisticInterval = 30 * time.Second
+	// A peer we are interested in that sent no block for this long is
+	// snubbing us, and only gets an optimistic unchoke
+	snubTimeout = time.Minute
+	// Peers unchoked for their rate when SessionConfig.UploadSlots is 0
+	defaultUploadSlots = 4
+)
+
+// runChoker picks the peers we upload to until ctx is cancelled. It follows
+// tit-for-tat: the interested peers that give us the most are unchoked,
+// plus one optimistic unchoke giving other peers a chance to prove
+// themselves.
+func (t *Torrent) runChoker(ctx context.Context) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	rounds := 0
+	t.rechoke(true)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rounds++
+			t.rechoke(rounds%int(optimisticInterval/chokeInterval) == 0)
+		case <-t.rechokeCh:
+			t.rechoke(false)
+		}
+	}
+}
+
+// requestRechoke asks the choker to run early because a peer changed its
+// interest or disconnected, so that upload slots don't stay free until the
+// next round.
+func (t *Torrent) requestRechoke() {
+	select {
+	case t.rechokeCh <- struct{}{}:
+	default:
+	}
+}
+
+// rechoke unchokes the interested peers with the best rates, the rates they
+// upload to us while downloading and the rates we upload to them while
+// seeding, and chokes the others. The optimistic unchoke moves to a random
+// choked peer when rotate is true or when it is gone.
+func (t *Torrent) rechoke(rotate bool) {
+	// Nothing left to download, skipped files aside
+	seeding := t.pm.complete()
+	now := time.Now()
+
+	t.mu.Lock()
+	var candidates []*peerStats
+	for _, p := range t.peers {
+		if p.connected.Load() && p.interested.Load() {
+			candidates = append(candidates, p)
+		}
+	}
+
+	rate := func(p *peerStats) float64 {
+		if seeding {
+			return p.up.Rate()
+		}
+		return p.down.Rate()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return rate(candidates[i]) > rate(candidates[j])
+	})
+
+	slots := t.uploadSlots
+	if slots <= 0 {
+		slots = defaultUploadSlots
+	}
+
+	unchoke := make(map[*peerStats]bool)
+	var rest []*peerStats
+	for _, p := range candidates {
+		if len(unchoke) < slots && (seeding || !p.snubbed(now)) {
+			unchoke[p] = true
+		} else {
+			rest = append(rest, p)
+		}
+	}
+
+	optimistic, ok := t.peers[t.optimistic]
+	if rotate || !ok || unchoke[optimistic] || !optimistic.interested.Load() {
+		t.optimistic = ""
+		if len(rest) > 0 {
+			optimistic = rest[rand.Intn(len(rest))]
+			t.optimistic = optimistic.addr
+		}
+	}
+	if t.optimistic != "" {
+		unchoke[optimistic] = true
+	}
+
+	peers := make([]*peerStats, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.mu.Unlock()
+
+	for _, p := range peers {
+		p.setChoking(!unchoke[p])
+	}
+}
+
+// snubbed reports whether the peer sent us no block for a while although we
+// are interested in it.
+func (p *peerStats) snubbed(now time.Time) bool {
+	if !p.amInterested.Load() {
+		return false
+	}
+
+	return now.Sub(time.Unix(0, p.lastBlock.Load())) > snubTimeout
+}
+
+// setChoking tells the peer whether we choke it, if that changed.
+func (p *peerStats) setChoking(choking bool) {
+	pc := p.pc.Load()
+	if pc == nil || p.choking.Swap(choking) == choking {
+		return
+	}
+
+	// Write failures surface in the worker reading from the connection
+	if choking {
+		pc.SendChoke()
+	} else {
+		pc.SendUnchoke()
+	}
+}
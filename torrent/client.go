@@ -2,79 +2,47 @@ package torrent
 
 import (
 	"bufio"
-	"fmt"
+	"context"
+	"log/slog"
 	"net/http"
-	"net/url"
-
-	"github.com/joaovictorsl/bencoding"
+	"sync"
 )
 
 type Client struct {
+	// Logger receives the logs of every torrent and peer, tagged with the
+	// torrent and peer they refer to. Wire-level messages are logged at
+	// LevelTrace.
+	//
+	// When nil nothing is logged.
+	Logger *slog.Logger
+	// Configures the requests to trackers and web seeds. It must not change
+	// once the client is in use.
+	HTTP HTTPConfig
+
+	httpOnce sync.Once
+	http     *http.Client
+	seedHTTP *http.Client
+	key      string
 }
 
-func (c *Client) Download(torrentFile *bufio.Reader) error {
-	td, err := c.decodeTorrentData(torrentFile)
-	if err != nil {
-		return err
+func (c *Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return discardLogger
 	}
+	return c.Logger
+}
 
-	infoHash := calcHash([]byte(td.Info.Encode()))
-
-	tr, err := c.discoverPeers(td.Announce, string(infoHash), fmt.Sprint(td.Info.Length))
+// Download downloads the torrent described by torrentFile into the working
+// directory and blocks until it is complete.
+func (c *Client) Download(torrentFile *bufio.Reader) error {
+	td, err := c.decodeTorrentData(torrentFile)
 	if err != nil {
 		return err
 	}
 
-	pm := NewPieceManager(td.Info.Pieces)
-	for _, peer := range tr.Peers {
-		go NewDownloadWorker(peer, infoHash, uint32(td.Info.PieceLength), pm).Process()
-	}
-
-	<-pm.done
-
-	return nil
+	return newTorrent(c, td, ".", nil).download(context.Background())
 }
 
 func (c *Client) decodeTorrentData(torrentFile *bufio.Reader) (*TorrentData, error) {
-	data, err := bencoding.DecodeTo[map[string]interface{}](torrentFile)
-	if err != nil {
-		return nil, err
-	}
-
-	return torrentDataFrom(data)
-}
-
-func (c *Client) discoverPeers(announce, infoHash, length string) (*TrackerResponse, error) {
-	params := url.Values{}
-	params.Add("info_hash", infoHash)
-	params.Add("peer_id", "00112233445566778899")
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", length)
-	params.Add("compact", "1")
-	params.Encode()
-
-	req, err := http.NewRequest(http.MethodGet, announce+"?"+params.Encode(), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	data, err := bencoding.DecodeTo[map[string]interface{}](bufio.NewReader(res.Body))
-	if err != nil {
-		return nil, err
-	}
-
-	tr, err := trackerResponseFrom(data)
-	if err != nil {
-		return nil, err
-	}
-
-	return tr, nil
+	return ReadTorrentData(torrentFile)
 }
@@ -0,0 +1,219 @@
+package torrent
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minCreatePieceLength = 16 * 1024
+	maxCreatePieceLength = 16 * 1024 * 1024
+	// Number of pieces the automatic piece length aims for
+	targetPieces = 1500
+)
+
+type CreateOptions struct {
+	// Tracker URLs grouped in tiers. The first URL is also used as the
+	// announce URL.
+	Trackers [][]string
+	// URLs of HTTP servers hosting the content (BEP 19).
+	WebSeeds []string
+	Comment  string
+	// Defaults to "mytorrent".
+	CreatedBy string
+	// Defaults to the current time. Use a negative Unix time to leave the
+	// creation date out.
+	CreationDate time.Time
+	Private      bool
+	// Piece length in bytes, a power of two. 0 picks one from the total
+	// size of the content.
+	PieceLength int
+	// Number of goroutines hashing pieces, 0 means one per CPU.
+	Workers int
+}
+
+// CreateTorrent builds the metainfo of the file or directory at path.
+// Directories are walked recursively and their files added in lexical
+// order.
+func CreateTorrent(path string, opts CreateOptions) (*TorrentData, error) {
+	path = filepath.Clean(path)
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &TorrentInfo{
+		Name:    filepath.Base(path),
+		Private: opts.Private,
+	}
+
+	if stat.IsDir() {
+		files, err := filesUnder(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.New("directory has no files")
+		}
+		info.Files = files
+	} else {
+		info.Length = int(stat.Size())
+	}
+
+	total := info.TotalLength()
+	if total == 0 {
+		return nil, errors.New("content is empty")
+	}
+
+	info.PieceLength = opts.PieceLength
+	if info.PieceLength == 0 {
+		info.PieceLength = pickPieceLength(int64(total))
+	}
+	if info.PieceLength <= 0 || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, errors.New("piece length must be a power of two")
+	}
+
+	info.Pieces, err = hashPieces(filepath.Dir(path), info, opts.Workers)
+	if err != nil {
+		return nil, err
+	}
+
+	td := &TorrentData{
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+		URLList:   opts.WebSeeds,
+		Info:      info,
+	}
+
+	if len(opts.Trackers) > 0 && len(opts.Trackers[0]) > 0 {
+		td.Announce = opts.Trackers[0][0]
+		if len(opts.Trackers) > 1 || len(opts.Trackers[0]) > 1 {
+			td.AnnounceList = opts.Trackers
+		}
+	}
+	if td.CreatedBy == "" {
+		td.CreatedBy = "mytorrent"
+	}
+
+	switch {
+	case opts.CreationDate.IsZero():
+		td.CreationDate = time.Now().Unix()
+	case opts.CreationDate.Unix() > 0:
+		td.CreationDate = opts.CreationDate.Unix()
+	}
+
+	// Names taken from the file system may not be valid in a torrent
+	if err := td.Validate(); err != nil {
+		return nil, err
+	}
+
+	return td, nil
+}
+
+// filesUnder lists the regular files under root in lexical order.
+func filesUnder(root string) ([]*TorrentFileInfo, error) {
+	var files []*TorrentFileInfo
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, &TorrentFileInfo{
+			Length: int(info.Size()),
+			Path:   strings.Split(filepath.ToSlash(rel), "/"),
+		})
+
+		return nil
+	})
+
+	return files, err
+}
+
+// pickPieceLength returns the smallest power of two that splits total
+// into at most targetPieces pieces, within sane bounds.
+func pickPieceLength(total int64) int {
+	length := int64(minCreatePieceLength)
+	for length < maxCreatePieceLength && total/length > targetPieces {
+		length *= 2
+	}
+	return int(length)
+}
+
+// hashPieces reads the content described by info from dir and returns the
+// SHA1 hash of every piece, hashing on workers goroutines.
+func hashPieces(dir string, info *TorrentInfo, workers int) ([]string, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	storage := newFileStorage(dir, info)
+	defer storage.closeFiles()
+	total := info.TotalLength()
+	numPieces := (total + info.PieceLength - 1) / info.PieceLength
+	hashes := make([]string, numPieces)
+
+	idxCh := make(chan int)
+	errCh := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, info.PieceLength)
+			for idx := range idxCh {
+				length := min(info.PieceLength, total-idx*info.PieceLength)
+				if err := storage.ReadPiece(uint32(idx), buf[:length]); err != nil {
+					errCh <- err
+					return
+				}
+				hashes[idx] = string(calcHash(buf[:length]))
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for idx := 0; idx < numPieces; idx++ {
+		select {
+		case idxCh <- idx:
+		case err = <-errCh:
+			break feed
+		}
+	}
+	close(idxCh)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case err := <-errCh:
+		return nil, err
+	default:
+	}
+
+	return hashes, nil
+}
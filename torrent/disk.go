@@ -0,0 +1,486 @@
+package torrent
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// SyncPolicy tells when the content of a torrent is flushed to stable
+// storage, beyond handing it to the operating system.
+type SyncPolicy int
+
+const (
+	// Sync once the download completes and when the torrent stops.
+	SyncOnComplete SyncPolicy = iota
+	// Sync after every batch of pieces written, which survives crashes of
+	// the whole system at the cost of throughput.
+	SyncAlways
+	// Leave it to the operating system.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncOnComplete:
+		return "complete"
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+}
+
+const (
+	defaultWriteCache = 64 << 20
+	defaultReadCache  = 32 << 20
+	// Longest single write adjacent pieces are merged into
+	maxCoalesce = 4 << 20
+	// Files of a torrent kept open at once
+	maxOpenFiles = 64
+)
+
+// Cache of the torrents that aren't part of a session
+var defaultDiskCache = newDiskCache(0, 0)
+
+// diskCache is the memory torrents share for the pieces verified and not
+// written yet, and for the pieces recently read to upload them. Workers wait
+// for the write budget before requesting more pieces, so that downloads slow
+// down to the pace of the disk. Saving a piece never waits, as it runs on
+// the hashing goroutines shared by every torrent: the budget is exceeded by
+// at most the pieces being downloaded and hashed when it ran out.
+type diskCache struct {
+	writeLimit int64
+	readLimit  int64
+
+	mu sync.Mutex
+	// Signalled whenever written pieces free their memory
+	freed *sync.Cond
+	dirty int64
+	// Pieces read, most recently used first
+	lru       *list.List
+	reads     map[readKey]*list.Element
+	readBytes int64
+}
+
+type readKey struct {
+	s   *fileStorage
+	idx uint32
+}
+
+type readEntry struct {
+	key  readKey
+	data []byte
+}
+
+// newDiskCache returns a cache of write and read bytes, defaultWriteCache
+// and defaultReadCache when 0. A negative read size disables the read cache.
+func newDiskCache(write, read int) *diskCache {
+	if write <= 0 {
+		write = defaultWriteCache
+	}
+	if read == 0 {
+		read = defaultReadCache
+	}
+
+	c := &diskCache{
+		writeLimit: int64(write),
+		readLimit:  int64(max(read, 0)),
+		lru:        list.New(),
+		reads:      make(map[readKey]*list.Element),
+	}
+	c.freed = sync.NewCond(&c.mu)
+	return c
+}
+
+// reserve takes n bytes of the write budget.
+func (c *diskCache) reserve(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty += int64(n)
+}
+
+func (c *diskCache) release(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dirty -= int64(n)
+	c.freed.Broadcast()
+}
+
+// waitWritable waits until the write budget isn't spent or ctx is done.
+func (c *diskCache) waitWritable(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.freed.Broadcast()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.dirty >= c.writeLimit && ctx.Err() == nil {
+		c.freed.Wait()
+	}
+	return ctx.Err()
+}
+
+// cached returns the piece at idx of s when it was read recently.
+func (c *diskCache) cached(s *fileStorage, idx uint32) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.reads[readKey{s, idx}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*readEntry).data, true
+}
+
+// keep adds the piece at idx of s to the read cache, evicting the pieces
+// read least recently.
+func (c *diskCache) keep(s *fileStorage, idx uint32, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := readKey{s, idx}
+	if _, ok := c.reads[key]; ok || int64(len(data)) > c.readLimit {
+		return
+	}
+	c.reads[key] = c.lru.PushFront(&readEntry{key, data})
+	c.readBytes += int64(len(data))
+
+	for c.readBytes > c.readLimit {
+		c.evict(c.lru.Back())
+	}
+}
+
+// forget drops the piece at idx of s from the read cache.
+func (c *diskCache) forget(s *fileStorage, idx uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.reads[readKey{s, idx}]; ok {
+		c.evict(e)
+	}
+}
+
+// forgetAll drops every piece of s from the read cache.
+func (c *diskCache) forgetAll(s *fileStorage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.reads {
+		if key.s == s {
+			c.evict(e)
+		}
+	}
+}
+
+// evict removes e from the read cache. c.mu must be held.
+func (c *diskCache) evict(e *list.Element) {
+	entry := c.lru.Remove(e).(*readEntry)
+	delete(c.reads, entry.key)
+	c.readBytes -= int64(len(entry.data))
+}
+
+// fileHandle is a file of a torrent kept open between reads and writes.
+type fileHandle struct {
+	f        *os.File
+	writable bool
+	refs     int
+	// Dropped from the open files, closed once the last user releases it
+	retired bool
+}
+
+// pendingPiece is a piece waiting in the write cache.
+type pendingPiece struct {
+	data []byte
+	// Called once the piece is written
+	done func(err error)
+}
+
+// WritePiece saves a verified piece. The piece is copied to the write cache
+// and written in the background, then done is called with the result of the
+// write. Once a write fails, the pieces saved afterwards fail right away.
+func (s *fileStorage) WritePiece(idx uint32, data []byte, done func(err error)) {
+	if err := s.writeErr(); err != nil {
+		done(err)
+		return
+	}
+
+	s.cache.reserve(len(data))
+	b := slices.Clone(data)
+	s.cache.forget(s, idx)
+
+	s.wmu.Lock()
+	old, replaced := s.pending[idx]
+	s.pending[idx] = pendingPiece{b, done}
+	if !s.flushing {
+		s.flushing = true
+		go s.flushLoop()
+	}
+	s.wmu.Unlock()
+
+	if replaced {
+		// Superseded by the same content
+		s.cache.release(len(old.data))
+		old.done(nil)
+	}
+}
+
+// flushLoop writes the pending pieces in order, runs of adjacent pieces at
+// once, until none are left.
+func (s *fileStorage) flushLoop() {
+	for {
+		s.wmu.Lock()
+		if len(s.pending) == 0 {
+			s.flushing = false
+			s.flushed.Broadcast()
+			s.wmu.Unlock()
+			return
+		}
+		idxs := make([]uint32, 0, len(s.pending))
+		for idx := range s.pending {
+			idxs = append(idxs, idx)
+		}
+		slices.Sort(idxs)
+		pieces := make([]pendingPiece, len(idxs))
+		for i, idx := range idxs {
+			pieces[i] = s.pending[idx]
+		}
+		s.wmu.Unlock()
+
+		for len(idxs) > 0 {
+			n, size := 1, len(pieces[0].data)
+			for n < len(idxs) && idxs[n] == idxs[n-1]+1 && size+len(pieces[n].data) <= maxCoalesce {
+				size += len(pieces[n].data)
+				n++
+			}
+
+			run := pieces[0].data
+			if n > 1 {
+				run = make([]byte, 0, size)
+				for _, p := range pieces[:n] {
+					run = append(run, p.data...)
+				}
+			}
+			err := s.writeAt(run, int64(idxs[0])*s.pieceLength)
+			if err == nil && s.syncPolicy == SyncAlways {
+				err = s.syncFiles()
+			}
+
+			var written []pendingPiece
+			s.wmu.Lock()
+			for i, idx := range idxs[:n] {
+				// The piece may have been saved again meanwhile, the new
+				// one took over
+				if cur, ok := s.pending[idx]; ok && &cur.data[0] == &pieces[i].data[0] {
+					delete(s.pending, idx)
+					written = append(written, pieces[i])
+				}
+			}
+			s.fail(err)
+			s.wmu.Unlock()
+
+			for _, p := range written {
+				s.cache.release(len(p.data))
+				p.done(err)
+			}
+			idxs, pieces = idxs[n:], pieces[n:]
+		}
+	}
+}
+
+// fail records the first write error. s.wmu must be held.
+func (s *fileStorage) fail(err error) {
+	if err != nil && s.err == nil {
+		s.err = err
+		close(s.failedCh)
+	}
+}
+
+// failed returns a channel closed once a write fails.
+func (s *fileStorage) failed() <-chan struct{} {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.failedCh
+}
+
+// writeErr returns the first write error.
+func (s *fileStorage) writeErr() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.err
+}
+
+// readPending copies the part of the piece at idx starting at begin to b
+// when the piece isn't written yet.
+func (s *fileStorage) readPending(idx uint32, begin int64, b []byte) bool {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	p, ok := s.pending[idx]
+	if ok {
+		copy(b, p.data[begin:])
+	}
+	return ok
+}
+
+// hasPending reports whether pieces wait to be written.
+func (s *fileStorage) hasPending() bool {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return len(s.pending) > 0
+}
+
+// flush waits for the pending pieces to be written.
+func (s *fileStorage) flush() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	for s.flushing {
+		s.flushed.Wait()
+	}
+	return s.err
+}
+
+// sync writes the pending pieces and, unless the policy is SyncNever,
+// flushes the files to stable storage.
+func (s *fileStorage) sync() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if s.syncPolicy == SyncNever {
+		return nil
+	}
+	return s.syncFiles()
+}
+
+// close syncs the content and closes the open files. The write error, if
+// any, is returned once and forgotten so that the next download tries
+// again.
+func (s *fileStorage) close() error {
+	err := s.sync()
+	s.closeFiles()
+	s.cache.forgetAll(s)
+
+	s.wmu.Lock()
+	if s.err != nil {
+		s.err = nil
+		s.failedCh = make(chan struct{})
+	}
+	s.wmu.Unlock()
+
+	return err
+}
+
+// syncFiles flushes every file open for writing to stable storage.
+func (s *fileStorage) syncFiles() error {
+	s.fdMu.Lock()
+	var handles []*fileHandle
+	for _, h := range s.fds {
+		if h.writable {
+			h.refs++
+			handles = append(handles, h)
+		}
+	}
+	s.fdMu.Unlock()
+
+	var errs []error
+	for _, h := range handles {
+		errs = append(errs, h.f.Sync())
+		s.release(h)
+	}
+	return errors.Join(errs...)
+}
+
+// closeFiles closes every open file, once no longer in use.
+func (s *fileStorage) closeFiles() {
+	s.fdMu.Lock()
+	defer s.fdMu.Unlock()
+
+	for path, h := range s.fds {
+		delete(s.fds, path)
+		s.retire(h)
+	}
+}
+
+// open returns the file f, opened for writing and created when write is
+// true. It must be released once done with.
+func (s *fileStorage) open(file storageFile, write bool) (*fileHandle, error) {
+	s.fdMu.Lock()
+	defer s.fdMu.Unlock()
+
+	path := file.path
+	h, ok := s.fds[path]
+	if ok && (h.writable || !write) {
+		h.refs++
+		return h, nil
+	}
+
+	var f *os.File
+	var err error
+	if write {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		// Opened for reading only
+		delete(s.fds, path)
+		s.retire(h)
+	}
+	for p, h := range s.fds {
+		if len(s.fds) < maxOpenFiles {
+			break
+		}
+		delete(s.fds, p)
+		s.retire(h)
+	}
+
+	h = &fileHandle{f: f, writable: write, refs: 1}
+	s.fds[path] = h
+	return h, nil
+}
+
+func (s *fileStorage) release(h *fileHandle) {
+	s.fdMu.Lock()
+	defer s.fdMu.Unlock()
+
+	h.refs--
+	if h.retired && h.refs == 0 {
+		s.closeHandle(h)
+	}
+}
+
+// retire closes h once no longer in use. s.fdMu must be held.
+func (s *fileStorage) retire(h *fileHandle) {
+	h.retired = true
+	if h.refs == 0 {
+		s.closeHandle(h)
+	}
+}
+
+func (s *fileStorage) closeHandle(h *fileHandle) {
+	if h.writable && s.syncPolicy != SyncNever {
+		// Syncing on completion only covers the files still open
+		h.f.Sync()
+	}
+	h.f.Close()
+}
@@ -1,195 +1,402 @@
 package torrent
 
 import (
-	"log"
+	"context"
+	"errors"
+	"log/slog"
 	"net"
-	"os"
+	"time"
 
 	"github.com/joaovictorsl/mytorrent/torrent/messages"
 )
 
+const (
+	blockLen = 16 * 1024
+	// Largest block a peer may request from us
+	maxRequestLen = 128 * 1024
+	// How long to wait for a message while there is nothing to download
+	// before looking for pieces again
+	idleReadTimeout = 2 * time.Second
+	// How long a peer may take to send the next message while we wait for
+	// the blocks we requested
+	requestTimeout = 30 * time.Second
+	// Most leaf hashes asked for at once, those of 8 MiB pieces
+	maxHashRequest = 512
+)
+
+// DownloadWorker drives the connection with a single peer: it downloads the
+// pieces the peer has and we lack, and serves the peer the pieces we have.
 type DownloadWorker struct {
 	pc       *PeerConn
 	infoHash []byte
 	pieceLen uint32
 	pm       *PieceManager
-	log      *log.Logger
-	logFile  *os.File
-	choked   bool
+	storage  *fileStorage
+	stats    *peerStats
+	// Called once the handshake succeeds
+	onConnected func()
+	log         *slog.Logger
+	choked      bool
+	// Called when the peer becomes interested in our pieces, or loses
+	// interest while unchoked
+	onInterest func()
+	// Pieces the peer announced through BITFIELD and HAVE
+	peerPieces []bool
+	interested bool
+	// Verifies and saves a downloaded piece in the background, taking over
+	// data, a buffer of pm. nil verifies pieces inline.
+	verify func(p Piece, data []byte, log *slog.Logger)
 }
 
-func NewDownloadWorker(peerAddr net.Addr, infoHash []byte, pieceLen uint32, pm *PieceManager) *DownloadWorker {
-	return &DownloadWorker{
-		pc:       NewPeerConn(peerAddr, pieceLen),
-		infoHash: infoHash,
-		pieceLen: pieceLen,
-		pm:       pm,
-		choked:   true,
+func NewDownloadWorker(peerAddr net.Addr, infoHash []byte, pieceLen uint32, pm *PieceManager, storage *fileStorage) *DownloadWorker {
+	w := &DownloadWorker{
+		pc:         NewPeerConn(peerAddr, pieceLen),
+		infoHash:   infoHash,
+		pieceLen:   pieceLen,
+		pm:         pm,
+		storage:    storage,
+		stats:      &peerStats{torrentDown: &rateMeter{}, torrentUp: &rateMeter{}},
+		log:        discardLogger.With("peer", peerAddr.String()),
+		choked:     true,
+		peerPieces: make([]bool, pm.TotalPieces()),
 	}
+	w.stats.choking.Store(true)
+	return w
 }
 
-func (w *DownloadWorker) Process() {
-	err := w.pc.Handshake(w.infoHash)
-	if err != nil {
-		return
-	}
+// newInboundDownloadWorker creates a worker for a peer that connected to us
+// and already exchanged handshakes over pc.
+func newInboundDownloadWorker(pc *PeerConn, infoHash []byte, pieceLen uint32, pm *PieceManager, storage *fileStorage) *DownloadWorker {
+	w := NewDownloadWorker(pc.addr, infoHash, pieceLen, pm, storage)
+	w.pc = pc
+	return w
+}
 
-	w.startLogger()
-	w.log.Println("Starting")
-	w.log.Println("Piece length", w.pieceLen)
+// Process exchanges pieces with the peer until the connection fails or ctx
+// is cancelled.
+func (w *DownloadWorker) Process(ctx context.Context) {
+	if w.pc.conn == nil {
+		err := w.pc.Handshake(ctx, w.infoHash)
+		if err != nil {
+			w.log.Debug("handshake failed", "err", err)
+			return
+		}
+	}
+	w.stats.lastBlock.Store(time.Now().UnixNano())
+	w.stats.connected.Store(true)
+	w.stats.pc.Store(w.pc)
+	if w.onConnected != nil {
+		w.onConnected()
+	}
 
-	defer w.logFile.Close()
+	// Unblock any pending read once we are told to stop
+	stop := context.AfterFunc(ctx, func() { w.pc.Close() })
+	defer stop()
 	defer w.pc.Close()
 
-	data := make([]byte, w.pieceLen)
-
-pieceLoop:
-	for p := range w.pm.pieceCh {
-		w.log.Printf("Downloading piece %d\n", p.Idx)
-
-		downloaded := uint32(0)
-		requested := uint32(0)
-		backlog := uint32(0)
-
-		for downloaded < w.pieceLen {
-			var msg messages.PeerMessage
-			if !w.choked {
-				for ; backlog < 5 && requested < w.pieceLen; backlog++ {
-					err := w.pc.SendRequest(p.Idx, requested, w.pieceLen)
-					if err != nil {
-						w.log.Println("Error when requesting piece", err)
-						w.pm.pieceCh <- p
-						continue pieceLoop
-					}
-					w.log.Println("Requested", requested)
-					requested += 16384
-				}
-			}
+	w.log.Debug("peer connected", "piece_length", w.pieceLen)
 
-			w.log.Println("Waiting for message")
-			msg, err = w.pc.ReadMessage()
-			if err != nil {
-				w.log.Println("Error when reading message", err)
-				w.pm.pieceCh <- p
+	if w.pm.DownloadedPieces() > 0 {
+		if err := w.pc.SendBitfield(w.pm.Bitfield()); err != nil {
+			w.log.Debug("failed to send bitfield", "err", err)
+			return
+		}
+	}
+
+	for ctx.Err() == nil {
+		// Request no more pieces while the disk falls behind
+		if w.storage.cache.waitWritable(ctx) != nil {
+			break
+		}
+
+		p, ok := w.pm.nextPiece(w.peerHas)
+		if !ok {
+			// Nothing to download from this peer right now, keep serving it
+			if err := w.serve(ctx); err != nil {
+				w.log.Debug("failed to read message", "err", err)
 				return
 			}
+			continue
+		}
 
-			switch msg.Type() {
-			case messages.CHOKE:
-				// Do something
-				w.log.Println("CHOKE")
-				w.choked = true
-				w.pm.pieceCh <- p
-				continue pieceLoop
-			case messages.UNCHOKE:
-				w.log.Println("UNCHOKE")
-				w.choked = false
-
-				for ; backlog < 5 && requested < w.pieceLen; backlog++ {
-					err := w.pc.SendRequest(p.Idx, requested, w.pieceLen)
-					if err != nil {
-						w.log.Println("Error when requesting piece", err)
-						w.pm.pieceCh <- p
-						continue pieceLoop
-					}
-					w.log.Println("Requested", requested)
-					requested += 16384
-				}
-			case messages.INTERESTED:
-				// Do something
-				w.log.Println("INTERESTED")
-			case messages.NOT_INTERESTED:
-				// Do something
-				w.log.Println("NOT_INTERESTED")
-			case messages.HAVE:
-				// Do something
-				w.log.Println("HAVE")
-			case messages.BITFIELD:
-				w.log.Println("BITFIELD")
-				// Just say you're interested
-				err := w.pc.SendInterest()
+		if err := w.downloadPiece(ctx, p); err != nil {
+			w.log.Debug("failed to download piece", "piece", p.Idx, "err", err)
+			w.pm.putBack(p)
+			return
+		}
+	}
+
+	w.log.Debug("peer done")
+}
+
+// serve handles the messages the peer sends while there is nothing to
+// download from it.
+func (w *DownloadWorker) serve(ctx context.Context) error {
+	w.pc.conn.SetReadDeadline(time.Now().Add(idleReadTimeout))
+	defer w.pc.conn.SetReadDeadline(time.Time{})
+
+	msg, err := w.pc.ReadMessage()
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	return w.handleMessage(ctx, msg)
+}
+
+// downloadPiece downloads p and hands it over to be verified and saved. The
+// piece is handed back to the piece manager when the peer chokes us or the
+// hash doesn't match; an error means the connection is unusable and the
+// caller must hand p back.
+func (w *DownloadWorker) downloadPiece(ctx context.Context, p Piece) error {
+	w.log.Debug("downloading piece", "piece", p.Idx)
+
+	data := w.pm.buffer()
+	handedOver := false
+	defer func() {
+		if !handedOver {
+			w.pm.putBuffer(data)
+		}
+	}()
+
+	downloaded := uint32(0)
+	requested := uint32(0)
+	backlog := uint32(0)
+
+	if !w.interested {
+		if err := w.sendInterested(); err != nil {
+			return err
+		}
+	}
+
+	// Ask v2 peers for the hashes of the blocks, which tell the bad ones
+	// apart when the piece doesn't match
+	var hashes *messages.HashRange
+	if w.pc.v2 && w.pc.peerV2 && p.leavesV2 > 1 && p.leavesV2 <= maxHashRequest {
+		r := messages.HashRange{Index: p.firstLeafV2, Length: uint32(p.leavesV2)}
+		copy(r.PiecesRoot[:], p.fileRootV2)
+		if err := w.pc.SendHashRequest(r); err != nil {
+			return err
+		}
+		hashes = &r
+	}
+
+	for downloaded < p.Length || hashes != nil {
+		if !w.choked {
+			for ; backlog < 5 && requested < p.Length; backlog++ {
+				err := w.pc.SendRequest(p.Idx, requested, p.Length)
 				if err != nil {
-					w.log.Println("Error when sending interest", err)
-					w.pm.pieceCh <- p
-					continue pieceLoop
-				}
-			case messages.REQUEST:
-				// Do something
-				w.log.Println("REQUEST")
-			case messages.PIECE:
-				msgPiece, ok := msg.(*messages.PieceMessage)
-				if !ok {
-					w.log.Println("Failed to cast message to PieceMessage")
-					continue pieceLoop
+					return err
 				}
+				w.log.Log(ctx, LevelTrace, "requested block", "piece", p.Idx, "begin", requested)
+				requested += blockLen
+			}
+		}
+
+		w.pc.conn.SetReadDeadline(time.Now().Add(requestTimeout))
+		msg, err := w.pc.ReadMessage()
+		if err != nil {
+			return err
+		}
 
-				copy(data[downloaded:], msgPiece.Block)
-				downloaded += uint32(len(msgPiece.Block))
-				w.log.Println("Downloaded", downloaded)
-
-				// Request other piece
-				if requested < w.pieceLen {
-					err := w.pc.SendRequest(p.Idx, requested, w.pieceLen)
-					if err != nil {
-						w.log.Println("Error when requesting piece", err)
-						w.pm.pieceCh <- p
-						continue pieceLoop
-					}
-					w.log.Println("Requested", requested)
-					requested += 16384
+		switch msg := msg.(type) {
+		case *messages.HashesMessage:
+			if hashes != nil && msg.HashRange == *hashes {
+				hashes = nil
+				var ok bool
+				if p, ok = p.withLeaves(msg.Hashes); !ok {
+					w.log.Debug("peer sent bad hashes", "piece", p.Idx)
 				}
-			case messages.CANCEL:
-				// Do something
-				w.log.Println("CANCEL")
-			default:
-				w.log.Println("Invalid message type", msg.Type())
-				w.pm.pieceCh <- p
-				return
+				continue
+			}
+		case *messages.HashRejectMessage:
+			if hashes != nil && msg.HashRange == *hashes {
+				hashes = nil
+				continue
 			}
 		}
 
-		if !w.pc.HashMatches(data, p.Hash) {
-			w.log.Println("Hash doesn't match")
-			w.pm.pieceCh <- p
+		if msg.Type() != messages.PIECE {
+			if err := w.handleMessage(ctx, msg); err != nil {
+				return err
+			}
+
+			if msg.Type() == messages.CHOKE {
+				// Requests are dropped on choke, try again later
+				w.pm.putBack(p)
+				return nil
+			}
 			continue
 		}
 
-		err := w.pc.SendHave(p.Idx)
-		if err != nil {
-			w.log.Println("Failed to send have message", err)
+		msgPiece, ok := msg.(*messages.PieceMessage)
+		if !ok {
+			return errors.New("failed to cast message to PieceMessage")
+		}
+		if msgPiece.Idx != p.Idx || msgPiece.Begin >= p.Length {
+			// Leftover block of a piece we gave up on
+			continue
 		}
 
-		err = w.savePiece(p.SavePath, data)
+		w.stats.addDownloaded(len(msgPiece.Block))
+		w.stats.lastBlock.Store(time.Now().UnixNano())
+		copy(data[msgPiece.Begin:p.Length], msgPiece.Block)
+		downloaded += uint32(len(msgPiece.Block))
+		w.log.Log(ctx, LevelTrace, "received block", "piece", p.Idx, "begin", msgPiece.Begin, "downloaded", downloaded)
+
+		// Request other piece
+		if requested < p.Length {
+			err := w.pc.SendRequest(p.Idx, requested, p.Length)
+			if err != nil {
+				return err
+			}
+			w.log.Log(ctx, LevelTrace, "requested block", "piece", p.Idx, "begin", requested)
+			requested += blockLen
+		}
+	}
+
+	w.pc.conn.SetReadDeadline(time.Time{})
+
+	if w.verify != nil {
+		// Keep downloading while the piece is hashed
+		handedOver = true
+		w.verify(p, data[:p.Length], w.log)
+		return nil
+	}
+
+	savePiece(p, data[:p.Length], p.verify(data[:p.Length]), w.pm, w.storage, w.log)
+	return nil
+}
+
+// savePiece saves a piece whose hash matches and marks it as downloaded
+// once written. It is handed back to the piece manager when the hash doesn't
+// match or the write fails.
+func savePiece(p Piece, data []byte, ok bool, pm *PieceManager, storage *fileStorage, log *slog.Logger) {
+	if !ok {
+		if bad := p.badBlocks(data); bad != nil {
+			log.Warn("piece hash doesn't match", "piece", p.Idx, "blocks", bad)
+		} else {
+			log.Warn("piece hash doesn't match", "piece", p.Idx)
+		}
+		pm.putBack(p)
+		return
+	}
+
+	storage.WritePiece(p.Idx, data, func(err error) {
 		if err != nil {
-			w.log.Println("Failed to save")
+			log.Error("failed to save piece", "piece", p.Idx, "err", err)
+			pm.putBack(p)
+			return
 		}
 
-		w.log.Printf("Successfully saved piece %d\n", p.Idx)
-		w.pm.Notify(p)
+		log.Debug("saved piece", "piece", p.Idx)
+		pm.Notify(p)
+	})
+}
+
+// handleMessage reacts to every message except the blocks of the piece being
+// downloaded.
+func (w *DownloadWorker) handleMessage(ctx context.Context, msg messages.PeerMessage) error {
+	w.log.Log(ctx, LevelTrace, "received message", "type", msg.Type())
+
+	switch msg := msg.(type) {
+	case *messages.ChokeMessage:
+		w.choked = true
+		w.stats.choked.Store(true)
+	case *messages.UnchokeMessage:
+		w.choked = false
+		w.stats.choked.Store(false)
+	case *messages.InterestedMessage:
+		w.stats.interested.Store(true)
+		if w.onInterest != nil {
+			w.onInterest()
+		}
+	case *messages.NotInterestedMessage:
+		w.stats.interested.Store(false)
+		if w.onInterest != nil && !w.stats.choking.Load() {
+			w.onInterest()
+		}
+	case *messages.HaveMessage:
+		if msg.Idx < uint32(len(w.peerPieces)) {
+			w.peerPieces[msg.Idx] = true
+		}
+		return w.updateInterest()
+	case *messages.BitfieldMessage:
+		for i := range w.peerPieces {
+			w.peerPieces[i] = msg.HasPiece(uint32(i))
+		}
+		return w.updateInterest()
+	case *messages.RequestMessage:
+		return w.serveRequest(msg)
+	case *messages.PieceMessage:
+		// Leftover block of a piece we gave up on
+	case *messages.CancelMessage:
+		// Requests are served as soon as they arrive, nothing to cancel
+	case *messages.HashRequestMessage:
+		// The hashes of the leaves aren't kept
+		return w.pc.SendHashReject(msg.HashRange)
+	case *messages.HashesMessage, *messages.HashRejectMessage:
+		// Answer about a piece we gave up on
+	default:
+		w.log.Debug("invalid message type", "type", msg.Type())
 	}
 
-	w.log.Println("Done")
+	return nil
 }
 
-func (w *DownloadWorker) savePiece(savePath string, data []byte) error {
-	f, err := os.OpenFile(savePath, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return err
+// updateInterest tells the peer we are interested once it has a piece we
+// lack.
+func (w *DownloadWorker) updateInterest() error {
+	if w.interested {
+		return nil
+	}
+
+	for i, has := range w.peerPieces {
+		if has && w.pm.wants(uint32(i)) {
+			return w.sendInterested()
+		}
 	}
-	defer f.Close()
 
-	_, err = f.Write(data)
-	return err
+	return nil
 }
 
-func (w *DownloadWorker) startLogger() error {
-	f, err := os.OpenFile("./log/"+w.pc.addr.String()+"_log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
+func (w *DownloadWorker) sendInterested() error {
+	if err := w.pc.SendInterest(); err != nil {
 		return err
 	}
+	w.interested = true
+	w.stats.amInterested.Store(true)
+	return nil
+}
+
+func (w *DownloadWorker) serveRequest(req *messages.RequestMessage) error {
+	if w.stats.choking.Load() || !w.pm.Has(req.Idx) || req.Length > maxRequestLen {
+		return nil
+	}
+
+	p := w.pm.pieces[req.Idx]
+	if req.Begin >= p.Length || req.Length > p.Length-req.Begin {
+		return nil
+	}
 
-	w.log = log.New(f, "[DownloadWorker] ", log.Flags())
-	w.logFile = f
+	block := make([]byte, req.Length)
+	if err := w.storage.ReadBlock(req.Idx, req.Begin, block); err != nil {
+		w.log.Error("failed to read block", "piece", req.Idx, "begin", req.Begin, "err", err)
+		return nil
+	}
+
+	if err := w.pc.SendPiece(req.Idx, req.Begin, block); err != nil {
+		return err
+	}
+	w.stats.addUploaded(len(block))
 
 	return nil
 }
+
+// peerHas reports whether the peer announced the piece at idx.
+func (w *DownloadWorker) peerHas(idx uint32) bool {
+	return w.peerPieces[idx]
+}
@@ -0,0 +1,193 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/joaovictorsl/mytorrent/torrent/messages"
+)
+
+// lockedBuffer is a bytes.Buffer safe to log to from several goroutines.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.String()
+}
+
+// newTestTorrentV2 returns a v2 only torrent of content, a single file split
+// in pieces of pieceLength bytes.
+func newTestTorrentV2(t *testing.T, content []byte, pieceLength int) *TorrentData {
+	t.Helper()
+
+	var layer []byte
+	for off := 0; off < len(content); off += pieceLength {
+		root := merkleRoot(content[off:min(off+pieceLength, len(content))], pieceLength/merkleBlockLen)
+		layer = append(layer, root[:]...)
+	}
+	blocks := (len(content) + merkleBlockLen - 1) / merkleBlockLen
+	root := merkleRoot(content, nextPow2(blocks))
+
+	td := &TorrentData{
+		Info: &TorrentInfo{
+			Name:        "file.bin",
+			PieceLength: pieceLength,
+			MetaVersion: 2,
+			FileTree:    []*TorrentFileV2{{Path: []string{"file.bin"}, Length: len(content), PiecesRoot: string(root[:])}},
+		},
+		PieceLayers: map[string]string{string(root[:]): string(layer)},
+	}
+	if err := td.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return td
+}
+
+// serveV2Peer plays a v2 seed of content on conn, corrupting the block at
+// corrupt the first time it is requested.
+func serveV2Peer(conn net.Conn, content []byte, pieceLength int, corrupt int) {
+	pc := newPeerConnFrom(conn, uint32(pieceLength))
+	defer pc.Close()
+
+	var leaves []byte
+	for off := 0; off < len(content); off += merkleBlockLen {
+		leaf := sha256.Sum256(content[off:min(off+merkleBlockLen, len(content))])
+		leaves = append(leaves, leaf[:]...)
+	}
+
+	pc.SendBitfield([]byte{0xff})
+	pc.SendUnchoke()
+	for {
+		msg, err := pc.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch msg := msg.(type) {
+		case *messages.RequestMessage:
+			off := int(msg.Idx)*pieceLength + int(msg.Begin)
+			block := bytes.Clone(content[off : off+int(msg.Length)])
+			if off == corrupt*merkleBlockLen {
+				block[0] ^= 0xff
+				corrupt = -1
+			}
+			pc.SendPiece(msg.Idx, msg.Begin, block)
+		case *messages.HashRequestMessage:
+			r := msg.HashRange
+			hashes := leaves[r.Index*32 : (r.Index+r.Length)*32]
+			pc.write(messages.NewHashesMessage(r, hashes).ToBytes())
+		}
+	}
+}
+
+func TestDownloadReportsBadBlock(t *testing.T) {
+	const pieceLength = 4 * merkleBlockLen
+	content := make([]byte, 2*pieceLength)
+	rand.Read(content)
+	td := newTestTorrentV2(t, content, pieceLength)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		// Second block of the second piece
+		serveV2Peer(conn, content, pieceLength, 5)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm := newPieceManager(piecesOf(td))
+	storage := newFileStorage(t.TempDir(), td.Info)
+	defer storage.close()
+
+	var logs lockedBuffer
+	pc := newPeerConnFrom(conn, pieceLength)
+	pc.v2, pc.peerV2 = true, true
+	w := newInboundDownloadWorker(pc, nil, pieceLength, pm, storage)
+	w.log = slog.New(slog.NewTextHandler(&logs, nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.Process(ctx)
+	}()
+
+	select {
+	case <-pm.Done():
+	case <-ctx.Done():
+		t.Fatalf("download didn't complete: %s", logs.String())
+	}
+	cancel()
+	<-stopped
+	if !strings.Contains(logs.String(), "piece=1 blocks=[1]") {
+		t.Errorf("bad block not reported: %s", logs.String())
+	}
+}
+
+func TestPieceBadBlocks(t *testing.T) {
+	data := make([]byte, 3*merkleBlockLen+100)
+	rand.Read(data)
+	root := merkleRoot(data, 4)
+	p := Piece{Length: uint32(len(data)), rootV2: root[:], lengthV2: uint32(len(data)), leavesV2: 4}
+
+	var hashes []byte
+	for off := 0; off < len(data); off += merkleBlockLen {
+		leaf := sha256.Sum256(data[off:min(off+merkleBlockLen, len(data))])
+		hashes = append(hashes, leaf[:]...)
+	}
+
+	if _, ok := p.withLeaves(hashes[32:]); ok {
+		t.Error("short hashes accepted")
+	}
+	forged := bytes.Clone(hashes)
+	forged[0] ^= 1
+	if _, ok := p.withLeaves(forged); ok {
+		t.Error("hashes not matching the root accepted")
+	}
+
+	p, ok := p.withLeaves(hashes)
+	if !ok {
+		t.Fatal("hashes rejected")
+	}
+	if !p.verify(data) {
+		t.Error("piece doesn't match")
+	}
+
+	data[2*merkleBlockLen] ^= 1
+	data[3*merkleBlockLen+99] ^= 1
+	if p.verify(data) {
+		t.Error("bad piece matches")
+	}
+	if bad := p.badBlocks(data); len(bad) != 2 || bad[0] != 2 || bad[1] != 3 {
+		t.Errorf("bad blocks = %v, want [2 3]", bad)
+	}
+}
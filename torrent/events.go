@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+)
+
+type EventType int
+
+const (
+	// A piece was downloaded, verified and saved. See Event.Piece.
+	EventPieceCompleted EventType = iota
+	// The handshake with a peer succeeded. See Event.Peer.
+	EventPeerConnected
+	// The connection with a peer was closed. See Event.Peer.
+	EventPeerDisconnected
+	// The torrent moved to another state. See Event.State.
+	EventStateChanged
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventPieceCompleted:
+		return "piece completed"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventStateChanged:
+		return "state changed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(e))
+	}
+}
+
+type Event struct {
+	Type     EventType
+	InfoHash InfoHash
+	// Index of the completed piece
+	Piece uint32
+	// Address of the peer that connected or disconnected
+	Peer string
+	// State the torrent moved to
+	State TorrentState
+}
+
+// eventHub fans events out to subscribers. Subscribers are called
+// synchronously from the goroutine that produced the event, so they must
+// not block.
+type eventHub struct {
+	mu     sync.Mutex
+	nextID int
+	subs   map[int]func(Event)
+	// Hub every event is forwarded to as well, used by sessions to observe
+	// all of their torrents
+	parent *eventHub
+}
+
+func newEventHub(parent *eventHub) *eventHub {
+	return &eventHub{
+		subs:   make(map[int]func(Event)),
+		parent: parent,
+	}
+}
+
+func (h *eventHub) subscribe(fn func(Event)) func() {
+	h.mu.Lock()
+	id := h.nextID
+	h.nextID++
+	h.subs[id] = fn
+	h.mu.Unlock()
+
+	return func() {
+		h.mu.Lock()
+		delete(h.subs, id)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mu.Lock()
+	subs := make([]func(Event), 0, len(h.subs))
+	for _, fn := range h.subs {
+		subs = append(subs, fn)
+	}
+	h.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(e)
+	}
+
+	if h.parent != nil {
+		h.parent.publish(e)
+	}
+}
@@ -0,0 +1,147 @@
+package torrent
+
+import "fmt"
+
+// FilePriority tells how eagerly the pieces of a file are downloaded.
+type FilePriority int
+
+const (
+	// Never download the file. Pieces shared with files we want are still
+	// downloaded, the parts of them falling into the skipped file are kept
+	// in a partfile so that the file isn't created.
+	FileSkip FilePriority = iota
+	FileLow
+	FileNormal
+	FileHigh
+)
+
+func (p FilePriority) String() string {
+	switch p {
+	case FileSkip:
+		return "skip"
+	case FileLow:
+		return "low"
+	case FileNormal:
+		return "normal"
+	case FileHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("FilePriority(%d)", int(p))
+	}
+}
+
+// TorrentFile is a file of the content of a torrent. Padding files are left
+// out.
+type TorrentFile struct {
+	// Path within the torrent, starting with the name of the torrent for
+	// multi-file torrents
+	Path     []string
+	Length   int64
+	Priority FilePriority
+}
+
+// Files returns the files of the torrent, in the order of the metainfo.
+func (t *Torrent) Files() []TorrentFile {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+
+	var files []TorrentFile
+	for _, f := range t.storage.files {
+		if f.pad {
+			continue
+		}
+		files = append(files, TorrentFile{
+			Path:     f.name,
+			Length:   f.length,
+			Priority: t.filePriorities[f.index],
+		})
+	}
+
+	return files
+}
+
+// SetFilePriority changes the priority of the file at idx in Files.
+func (t *Torrent) SetFilePriority(idx int, priority FilePriority) error {
+	files := t.Files()
+	if idx < 0 || idx >= len(files) {
+		return fmt.Errorf("file %d out of range [0, %d)", idx, len(files))
+	}
+
+	priorities := make([]FilePriority, len(files))
+	for i, f := range files {
+		priorities[i] = f.Priority
+	}
+	priorities[idx] = priority
+
+	return t.SetFilePriorities(priorities)
+}
+
+// SetFilePriorities changes the priority of every file, in the order of
+// Files. Pieces of files with higher priorities are downloaded first, and the
+// download completes once every file not skipped is. A completed torrent
+// goes back to the queue when skipped files are wanted again.
+func (t *Torrent) SetFilePriorities(priorities []FilePriority) error {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+
+	var indexes []int
+	for _, f := range t.storage.files {
+		if !f.pad {
+			indexes = append(indexes, f.index)
+		}
+	}
+	if len(priorities) != len(indexes) {
+		return fmt.Errorf("got %d priorities for %d files", len(priorities), len(indexes))
+	}
+	for _, p := range priorities {
+		if p < FileSkip || p > FileHigh {
+			return fmt.Errorf("invalid file priority %d", int(p))
+		}
+	}
+
+	for i, idx := range indexes {
+		if err := t.storage.setSkipped(idx, priorities[i] == FileSkip); err != nil {
+			return err
+		}
+		t.filePriorities[idx] = priorities[i]
+	}
+
+	if t.pm.setPriorities(t.piecePriorities()) {
+		t.reopen()
+	}
+
+	return nil
+}
+
+// piecePriorities returns the priority of every piece, the highest of the
+// files it overlaps. t.filesMu must be held.
+func (t *Torrent) piecePriorities() []FilePriority {
+	priorities := make([]FilePriority, len(t.pm.pieces))
+	pieceLength := t.storage.pieceLength
+	for _, f := range t.storage.files {
+		if f.pad || f.length == 0 {
+			continue
+		}
+
+		prio := t.filePriorities[f.index]
+		last := (f.offset + f.length - 1) / pieceLength
+		for idx := f.offset / pieceLength; idx <= last; idx++ {
+			priorities[idx] = max(priorities[idx], prio)
+		}
+	}
+
+	return priorities
+}
+
+// reopen queues a completed torrent again, once it has pieces to download
+// again.
+func (t *Torrent) reopen() {
+	switch t.State() {
+	case StateCompleted, StateSeeding:
+		t.stop(StateQueued)
+		t.setState(StateQueued)
+		if t.onStop != nil {
+			t.onStop()
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+func statFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return st.F_bavail * int64(st.F_bsize), nil
+}
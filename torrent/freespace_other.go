@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd && !windows
+
+package torrent
+
+import "errors"
+
+// statFree is unsupported on the remaining platforms, like NetBSD whose
+// syscall package lacks statvfs: the free space is never checked there.
+func statFree(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
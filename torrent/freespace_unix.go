@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+func statFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// HTTPHandler serves the files of the torrents of the session like a plain
+// HTTP mirror would, at /<info hash>/<path of the file within the torrent>.
+// Range requests are supported, and the pieces a request reads are
+// downloaded before any other. Requests for files that aren't downloaded and
+// whose torrent isn't running fail with 503 Service Unavailable.
+//
+// / lists the torrents of the session and /<info hash>/ the files of a
+// torrent.
+func (s *Session) HTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.serveTorrents)
+	mux.HandleFunc("GET /{hash}/{$}", s.serveFiles)
+	mux.HandleFunc("GET /{hash}/{path...}", s.serveFile)
+	return mux
+}
+
+func (s *Session) serveTorrents(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, t := range s.List() {
+		fmt.Fprintf(&b, "<li><a href=\"%s/\">%s</a></li>\n", t.InfoHash(), html.EscapeString(t.Name()))
+	}
+	writeIndex(w, "Torrents", b.String())
+}
+
+func (s *Session) serveFiles(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.torrentFrom(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var b strings.Builder
+	for _, f := range t.Files() {
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n",
+			fileURL(f.Path), html.EscapeString(path.Join(f.Path...)), f.Length)
+	}
+	writeIndex(w, html.EscapeString(t.Name()), b.String())
+}
+
+func (s *Session) serveFile(w http.ResponseWriter, r *http.Request) {
+	t, ok := s.torrentFrom(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	idx := -1
+	for i, f := range t.Files() {
+		if path.Join(f.Path...) == r.PathValue("path") {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	reader, err := t.NewReaderContext(r.Context(), idx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	switch t.State() {
+	case StateChecking, StateDownloading, StateSeeding:
+	default:
+		if !reader.complete() {
+			http.Error(w, "torrent is not running", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	name := reader.file.name[len(reader.file.name)-1]
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+// torrentFrom returns the torrent whose info hash is in the URL of r.
+func (s *Session) torrentFrom(r *http.Request) (*Torrent, bool) {
+	b, err := hex.DecodeString(r.PathValue("hash"))
+	if err != nil || len(b) != len(InfoHash{}) {
+		return nil, false
+	}
+
+	t, err := s.Get(InfoHash(b))
+	return t, err == nil
+}
+
+// fileURL returns the URL of a file relative to the listing of its torrent.
+func fileURL(p []string) string {
+	escaped := make([]string, len(p))
+	for i, part := range p {
+		escaped[i] = url.PathEscape(part)
+	}
+	return strings.Join(escaped, "/")
+}
+
+func writeIndex(w http.ResponseWriter, title, items string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<h1>%s</h1>\n<ul>\n%s</ul>\n", title, title, items)
+}
@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// Pieces waiting for a hashing goroutine, per goroutine, before submitting
+// more blocks
+const hashQueuePerWorker = 4
+
+// Pool of the torrents that aren't part of a session
+var defaultHashPool = newHashPool(0)
+
+// hashPool verifies pieces on a bounded number of goroutines, started as
+// pieces are submitted and stopped once there are none left, so that
+// downloads keep going while pieces are hashed.
+type hashPool struct {
+	jobs    chan hashJob
+	workers chan struct{}
+	// Pieces submitted and not verified yet
+	queued atomic.Int64
+}
+
+type hashJob struct {
+	piece Piece
+	data  []byte
+	done  func(ok bool)
+}
+
+// newHashPool returns a pool of n goroutines, one per CPU when n is 0.
+func newHashPool(n int) *hashPool {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+
+	return &hashPool{
+		jobs:    make(chan hashJob, n*hashQueuePerWorker),
+		workers: make(chan struct{}, n),
+	}
+}
+
+// submit verifies data against the hashes of p in the background, then
+// calls done with the result. It blocks while the queue is full.
+func (hp *hashPool) submit(p Piece, data []byte, done func(ok bool)) {
+	hp.queued.Add(1)
+	hp.jobs <- hashJob{p, data, done}
+
+	select {
+	case hp.workers <- struct{}{}:
+		go hp.work()
+	default:
+		// Every goroutine is busy, one of them will take the job
+	}
+}
+
+func (hp *hashPool) work() {
+	for {
+		for len(hp.jobs) > 0 {
+			select {
+			case job := <-hp.jobs:
+				ok := job.piece.verify(job.data)
+				hp.queued.Add(-1)
+				job.done(ok)
+			default:
+			}
+		}
+
+		<-hp.workers
+		// A job submitted while we were leaving may have seen every
+		// goroutine busy
+		if len(hp.jobs) == 0 {
+			return
+		}
+		select {
+		case hp.workers <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// depth returns the number of pieces submitted and not verified yet.
+func (hp *hashPool) depth() int {
+	return int(hp.queued.Load())
+}
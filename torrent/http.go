@@ -0,0 +1,172 @@
+package torrent
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTrackerTimeout = 30 * time.Second
+	defaultUserAgent      = "mytorrent"
+	// How long the stopped announce may hold up stopping a torrent
+	stoppedAnnounceTimeout = 5 * time.Second
+)
+
+// HTTPConfig configures the HTTP requests sent to trackers and web seeds.
+type HTTPConfig struct {
+	// Client sending the requests. When set, Timeout, Proxy and RootCAs are
+	// ignored.
+	Client *http.Client
+	// Time limit of a tracker request, including reading the response. Web
+	// seeds are limited per piece instead.
+	//
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+	// Proxy every request goes through. When nil the proxy is taken from
+	// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy *url.URL
+	// Certificate authorities trusted for HTTPS, nil means the ones of the
+	// system. See LoadCertPool.
+	RootCAs *x509.CertPool
+	// Sent as the User-Agent header.
+	//
+	// Defaults to "mytorrent".
+	UserAgent string
+	// Sent to trackers so they can recognize us when our IP address
+	// changes.
+	//
+	// Defaults to a random value picked once per Client.
+	Key string
+}
+
+// LoadCertPool reads a bundle of PEM encoded certificates, to be used as
+// HTTPConfig.RootCAs.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s has no certificates", path)
+	}
+
+	return pool, nil
+}
+
+// httpClient returns the client of the HTTP configuration for trackers,
+// built on first use.
+func (c *Client) httpClient() *http.Client {
+	c.httpOnce.Do(func() {
+		cfg := c.HTTP
+		c.key = cfg.Key
+		if c.key == "" {
+			var b [4]byte
+			rand.Read(b[:])
+			c.key = hex.EncodeToString(b[:])
+		}
+
+		if cfg.Client != nil {
+			c.http = cfg.Client
+			c.seedHTTP = cfg.Client
+			return
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyFromEnvironment
+		if cfg.Proxy != nil {
+			transport.Proxy = http.ProxyURL(cfg.Proxy)
+		}
+		if cfg.RootCAs != nil {
+			transport.TLSClientConfig = &tls.Config{RootCAs: cfg.RootCAs}
+		}
+
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = defaultTrackerTimeout
+		}
+
+		c.http = &http.Client{Transport: transport, Timeout: timeout}
+		c.seedHTTP = &http.Client{Transport: transport}
+	})
+
+	return c.http
+}
+
+// seedClient returns the client for web seeds, sharing the connections of
+// the tracker one but without its timeout: a piece may take longer than an
+// announce to download.
+func (c *Client) seedClient() *http.Client {
+	c.httpClient()
+	return c.seedHTTP
+}
+
+// announceKey returns the key sent in announces.
+func (c *Client) announceKey() string {
+	c.httpClient()
+	return c.key
+}
+
+func (c *Client) newRequest(ctx context.Context, u string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ua := c.HTTP.UserAgent
+	if ua == "" {
+		ua = defaultUserAgent
+	}
+	req.Header.Set("User-Agent", ua)
+
+	return req, nil
+}
+
+// getTracker sends a GET request to a tracker. Responses are accepted gzip
+// compressed whether or not the client would decompress them on its own.
+func (c *Client) getTracker(ctx context.Context, u string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		res.Body = &gzipBody{Reader: zr, body: res.Body}
+		res.Header.Del("Content-Encoding")
+	}
+
+	return res, nil
+}
+
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
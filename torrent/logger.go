@@ -0,0 +1,21 @@
+package torrent
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LevelTrace is the level of wire-level messages, such as every block
+// requested and every message received from peers. It is below
+// slog.LevelDebug so it must be enabled explicitly.
+const LevelTrace = slog.LevelDebug - 4
+
+// discardLogger is used when the Client has no Logger.
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
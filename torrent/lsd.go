@@ -0,0 +1,222 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How often every running torrent is announced on the local network
+	lsdInterval = 5 * time.Minute
+	// How often torrents that started running are looked for
+	lsdPoll = 10 * time.Second
+	// Info hashes per announce, which must fit a single datagram
+	lsdBatch = 20
+)
+
+var (
+	lsdGroup4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	lsdGroup6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// lsd finds peers on the local network through Local Service Discovery (BEP
+// 14): the torrents we run are announced to a multicast group, and the
+// announces of the other peers of the group are handed to onPeer.
+type lsd struct {
+	port   int
+	cookie string
+	socks  []lsdSocket
+	onPeer func(infoHash InfoHash, addr net.Addr)
+	closed chan struct{}
+	// When every running info hash was last announced
+	announced map[InfoHash]time.Time
+}
+
+// lsdSocket is a socket that joined a multicast group.
+type lsdSocket struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+}
+
+// newLSD joins the IPv4 and IPv6 multicast groups on every interface,
+// loopback included so that peers on the same host find each other, and
+// fails only when no group can be joined. port is the port peers connect to
+// us on.
+func newLSD(port int, onPeer func(infoHash InfoHash, addr net.Addr)) (*lsd, error) {
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+
+	l := &lsd{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		onPeer:    onPeer,
+		closed:    make(chan struct{}),
+		announced: make(map[InfoHash]time.Time),
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&(net.FlagMulticast|net.FlagLoopback) == 0 {
+			continue
+		}
+
+		for _, group := range []*net.UDPAddr{lsdGroup4, lsdGroup6} {
+			network := "udp4"
+			if group.IP.To4() == nil {
+				network = "udp6"
+			}
+			// Every socket receives the announces of all interfaces, peers
+			// are heard of several times
+			conn, err := net.ListenMulticastUDP(network, &ifi, group)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", ifi.Name, err))
+				continue
+			}
+			l.socks = append(l.socks, lsdSocket{conn, group})
+			go l.readLoop(conn)
+		}
+	}
+	if len(l.socks) == 0 {
+		return nil, fmt.Errorf("no multicast group joined: %w", errors.Join(errs...))
+	}
+
+	return l, nil
+}
+
+func (l *lsd) Close() error {
+	close(l.closed)
+	for _, s := range l.socks {
+		s.conn.Close()
+	}
+	return nil
+}
+
+// run announces the info hashes returned by running as they start running,
+// and then every lsdInterval, until the LSD is closed.
+func (l *lsd) run(running func() []InfoHash) {
+	ticker := time.NewTicker(lsdPoll)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		var due []InfoHash
+		announced := make(map[InfoHash]time.Time)
+		for _, h := range running() {
+			announced[h] = l.announced[h]
+			if now.Sub(announced[h]) >= lsdInterval {
+				announced[h] = now
+				due = append(due, h)
+			}
+		}
+		// Torrents that stopped are announced again once they run
+		l.announced = announced
+
+		for _, batch := range batches(due, lsdBatch) {
+			l.announce(batch)
+		}
+
+		select {
+		case <-l.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announce sends a single announce of hashes to every group joined.
+func (l *lsd) announce(hashes []InfoHash) {
+	for _, s := range l.socks {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", s.group, l.port)
+		for _, h := range hashes {
+			fmt.Fprintf(&b, "Infohash: %s\r\n", h)
+		}
+		fmt.Fprintf(&b, "cookie: %s\r\n\r\n\r\n", l.cookie)
+
+		s.conn.WriteToUDP(b.Bytes(), s.group)
+	}
+}
+
+func (l *lsd) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		port, hashes, cookie, ok := parseLSDAnnounce(buf[:n])
+		if !ok || cookie == l.cookie {
+			// Malformed, or our own announce looped back
+			continue
+		}
+
+		addr := &net.TCPAddr{IP: from.IP, Port: port, Zone: from.Zone}
+		for _, h := range hashes {
+			l.onPeer(h, addr)
+		}
+	}
+}
+
+// parseLSDAnnounce reads the port peers connect to, the info hashes and the
+// cookie of an announce.
+func parseLSDAnnounce(b []byte) (port int, hashes []InfoHash, cookie string, ok bool) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", false
+	}
+
+	// Headers are parsed by hand as Infohash may repeat and keys are
+	// case-insensitive
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" || err != nil {
+			break
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch http.CanonicalHeaderKey(strings.TrimSpace(key)) {
+		case "Port":
+			port, err = strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return 0, nil, "", false
+			}
+		case "Infohash":
+			var h InfoHash
+			if decoded, err := hex.DecodeString(value); err == nil && len(decoded) == len(h) {
+				copy(h[:], decoded)
+				hashes = append(hashes, h)
+			}
+		case "Cookie":
+			cookie = value
+		}
+	}
+
+	return port, hashes, cookie, port != 0 && len(hashes) > 0
+}
@@ -0,0 +1,96 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type lsdPeer struct {
+	infoHash InfoHash
+	addr     net.Addr
+}
+
+func newTestLSD(t *testing.T, port int) (*lsd, <-chan lsdPeer) {
+	t.Helper()
+
+	peers := make(chan lsdPeer, 16)
+	l, err := newLSD(port, func(infoHash InfoHash, addr net.Addr) {
+		peers <- lsdPeer{infoHash, addr}
+	})
+	if err != nil {
+		t.Skipf("multicast unavailable: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	return l, peers
+}
+
+func TestLSDAnnounce(t *testing.T) {
+	listener, heard := newTestLSD(t, 6001)
+	announcer, echoed := newTestLSD(t, 6002)
+
+	hash := InfoHash{1, 2, 3}
+	announcer.announce([]InfoHash{hash})
+
+	select {
+	case p := <-heard:
+		if p.infoHash != hash {
+			t.Errorf("info hash = %s, want %s", p.infoHash, hash)
+		}
+		if port := p.addr.(*net.TCPAddr).Port; port != 6002 {
+			t.Errorf("port = %d, want 6002", port)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("announce not received")
+	}
+
+	// Every socket hears the announce, only the listener must report it
+	listener.announce([]InfoHash{{4, 5, 6}})
+	deadline := time.After(500 * time.Millisecond)
+	for {
+		select {
+		case p := <-echoed:
+			if p.addr.(*net.TCPAddr).Port == 6002 {
+				t.Fatalf("own announce reported: %v", p)
+			}
+		case p := <-heard:
+			if p.addr.(*net.TCPAddr).Port == 6001 {
+				t.Fatalf("own announce reported: %v", p)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func TestParseLSDAnnounce(t *testing.T) {
+	msg := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: 239.192.152.143:6771\r\n" +
+		"Port: 6881\r\n" +
+		"Infohash: 0102030000000000000000000000000000000000\r\n" +
+		"infohash: 0405060000000000000000000000000000000000\r\n" +
+		"cookie: abc\r\n\r\n\r\n"
+
+	port, hashes, cookie, ok := parseLSDAnnounce([]byte(msg))
+	if !ok {
+		t.Fatal("announce rejected")
+	}
+	if port != 6881 || cookie != "abc" {
+		t.Errorf("port, cookie = %d, %q, want 6881, \"abc\"", port, cookie)
+	}
+	if len(hashes) != 2 || hashes[0] != (InfoHash{1, 2, 3}) || hashes[1] != (InfoHash{4, 5, 6}) {
+		t.Errorf("hashes = %v", hashes)
+	}
+
+	for _, bad := range []string{
+		"",
+		"M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0102030000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: 0102030000000000000000000000000000000000\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	} {
+		if _, _, _, ok := parseLSDAnnounce([]byte(bad)); ok {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"crypto/sha256"
+)
+
+// Size of the leaves of the merkle trees of v2 torrents (BEP 52)
+const merkleBlockLen = 16 * 1024
+
+// merkleRoot returns the root of the SHA-256 merkle tree over the 16 KiB
+// blocks of data. The last block may be short, and the tree is padded with
+// zero leaves up to leaves, a power of two.
+func merkleRoot(data []byte, leaves int) [32]byte {
+	hashes := make([][32]byte, 0, (len(data)+merkleBlockLen-1)/merkleBlockLen)
+	for off := 0; off < len(data); off += merkleBlockLen {
+		hashes = append(hashes, sha256.Sum256(data[off:min(off+merkleBlockLen, len(data))]))
+	}
+
+	return merkleReduce(hashes, leaves, [32]byte{})
+}
+
+// merkleReduce returns the root of the tree whose bottom layer is hashes,
+// padded with pad up to width nodes, a power of two.
+func merkleReduce(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, max(width, 1))
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = pad
+		}
+	}
+
+	var pair [64]byte
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			copy(pair[:32], layer[2*i][:])
+			copy(pair[32:], layer[2*i+1][:])
+			layer[i] = sha256.Sum256(pair[:])
+		}
+		layer = layer[:len(layer)/2]
+	}
+
+	return layer[0]
+}
+
+// nextPow2 returns the smallest power of two not below n.
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
@@ -19,6 +19,16 @@ func FromBytesBitfieldMessage(b []byte) *BitfieldMessage {
 	}
 }
 
+// HasPiece reports whether the bitfield has the bit of the piece at idx set.
+func (msg *BitfieldMessage) HasPiece(idx uint32) bool {
+	byteIdx := idx / 8
+	if byteIdx >= uint32(len(msg.bitfield)) {
+		return false
+	}
+
+	return msg.bitfield[byteIdx]&(0x80>>(idx%8)) != 0
+}
+
 func (msg *BitfieldMessage) Type() int {
 	return BITFIELD
 }
@@ -10,4 +10,8 @@ const (
 	REQUEST        = 6
 	PIECE          = 7
 	CANCEL         = 8
+	// Merkle tree hashes of v2 torrents (BEP 52)
+	HASH_REQUEST = 21
+	HASHES       = 22
+	HASH_REJECT  = 23
 )
@@ -0,0 +1,106 @@
+package messages
+
+import "encoding/binary"
+
+const hashRangeLen = 48
+
+// HashRange identifies hashes of the merkle tree of a file in v2 torrents
+// (BEP 52): Length hashes of the layer BaseLayer, counted from the leaves,
+// starting at Index, with the uncle hashes of ProofLayers layers above.
+type HashRange struct {
+	PiecesRoot  [32]byte
+	BaseLayer   uint32
+	Index       uint32
+	Length      uint32
+	ProofLayers uint32
+}
+
+func hashRangeFrom(b []byte) HashRange {
+	r := HashRange{
+		BaseLayer:   binary.BigEndian.Uint32(b[32:36]),
+		Index:       binary.BigEndian.Uint32(b[36:40]),
+		Length:      binary.BigEndian.Uint32(b[40:44]),
+		ProofLayers: binary.BigEndian.Uint32(b[44:48]),
+	}
+	copy(r.PiecesRoot[:], b)
+	return r
+}
+
+// toBytes encodes the message of id made of the range followed by extra.
+func (r HashRange) toBytes(id byte, extra []byte) []byte {
+	b := make([]byte, 0, 5+hashRangeLen+len(extra))
+	b = binary.BigEndian.AppendUint32(b, uint32(1+hashRangeLen+len(extra)))
+	b = append(b, id)
+	b = append(b, r.PiecesRoot[:]...)
+	b = binary.BigEndian.AppendUint32(b, r.BaseLayer)
+	b = binary.BigEndian.AppendUint32(b, r.Index)
+	b = binary.BigEndian.AppendUint32(b, r.Length)
+	b = binary.BigEndian.AppendUint32(b, r.ProofLayers)
+	return append(b, extra...)
+}
+
+type HashRequestMessage struct {
+	HashRange
+}
+
+func NewHashRequestMessage(r HashRange) *HashRequestMessage {
+	return &HashRequestMessage{r}
+}
+
+func FromBytesHashRequestMessage(b []byte) *HashRequestMessage {
+	return &HashRequestMessage{hashRangeFrom(b)}
+}
+
+func (msg *HashRequestMessage) Type() int {
+	return HASH_REQUEST
+}
+
+func (msg *HashRequestMessage) ToBytes() []byte {
+	return msg.toBytes(HASH_REQUEST, nil)
+}
+
+type HashesMessage struct {
+	HashRange
+	// The hashes of the range followed by the proof hashes, 32 bytes each
+	Hashes []byte
+}
+
+func NewHashesMessage(r HashRange, hashes []byte) *HashesMessage {
+	return &HashesMessage{r, hashes}
+}
+
+func FromBytesHashesMessage(b []byte) *HashesMessage {
+	return &HashesMessage{
+		HashRange: hashRangeFrom(b),
+		Hashes:    b[hashRangeLen:],
+	}
+}
+
+func (msg *HashesMessage) Type() int {
+	return HASHES
+}
+
+func (msg *HashesMessage) ToBytes() []byte {
+	return msg.toBytes(HASHES, msg.Hashes)
+}
+
+// HashRejectMessage answers a hash request that won't be served.
+type HashRejectMessage struct {
+	HashRange
+}
+
+func NewHashRejectMessage(r HashRange) *HashRejectMessage {
+	return &HashRejectMessage{r}
+}
+
+func FromBytesHashRejectMessage(b []byte) *HashRejectMessage {
+	return &HashRejectMessage{hashRangeFrom(b)}
+}
+
+func (msg *HashRejectMessage) Type() int {
+	return HASH_REJECT
+}
+
+func (msg *HashRejectMessage) ToBytes() []byte {
+	return msg.toBytes(HASH_REJECT, nil)
+}
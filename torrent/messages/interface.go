@@ -1,6 +1,7 @@
 package messages
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -9,10 +10,29 @@ type PeerMessage interface {
 	Type() int
 }
 
+// Smallest payload, without the message id, of the messages that carry
+// one
+var minPayloadLen = map[byte]int{
+	HAVE:         4,
+	REQUEST:      12,
+	PIECE:        8,
+	CANCEL:       12,
+	HASH_REQUEST: hashRangeLen,
+	HASHES:       hashRangeLen,
+	HASH_REJECT:  hashRangeLen,
+}
+
 func FromBytes(b []byte) (PeerMessage, error) {
 	var msg PeerMessage
+	if len(b) == 0 {
+		return nil, errors.New("empty message")
+	}
 	msgId := b[0]
 
+	if len(b)-1 < minPayloadLen[msgId] {
+		return nil, fmt.Errorf("message %d of %d bytes is too short", msgId, len(b))
+	}
+
 	switch msgId {
 	case CHOKE:
 		msg = FromBytesChokeMessage()
@@ -20,12 +40,24 @@ func FromBytes(b []byte) (PeerMessage, error) {
 		msg = FromBytesUnchokeMessage()
 	case INTERESTED:
 		msg = FromBytesInterestedMessage()
+	case NOT_INTERESTED:
+		msg = FromBytesNotInterestedMessage()
+	case HAVE:
+		msg = FromBytesHaveMessage(b[1:])
 	case BITFIELD:
 		msg = FromBytesBitfieldMessage(b[1:])
 	case REQUEST:
 		msg = FromBytesRequestMessage(b[1:])
 	case PIECE:
 		msg = FromBytesPieceMessage(b[1:])
+	case CANCEL:
+		msg = FromBytesCancelMessage(b[1:])
+	case HASH_REQUEST:
+		msg = FromBytesHashRequestMessage(b[1:])
+	case HASHES:
+		msg = FromBytesHashesMessage(b[1:])
+	case HASH_REJECT:
+		msg = FromBytesHashRejectMessage(b[1:])
 	default:
 		return nil, fmt.Errorf("id not implemented: %d", msgId)
 	}
@@ -0,0 +1,49 @@
+package messages
+
+import "testing"
+
+func TestFromBytesTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"have", []byte{HAVE, 0, 0, 1}},
+		{"request", []byte{REQUEST, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0x40}},
+		{"piece", []byte{PIECE, 0, 0, 0, 1, 0, 0, 0}},
+		{"cancel", []byte{CANCEL, 0, 0, 0, 1}},
+		{"hash request", append([]byte{HASH_REQUEST}, make([]byte, hashRangeLen-1)...)},
+		{"hashes", []byte{HASHES}},
+		{"hash reject", []byte{HASH_REJECT, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := FromBytes(tt.b)
+			if err == nil {
+				t.Fatalf("parsed %d bytes into %T, want an error", len(tt.b), msg)
+			}
+		})
+	}
+}
+
+func TestFromBytesRoundTrip(t *testing.T) {
+	msgs := []PeerMessage{
+		NewHaveMessage(7),
+		NewRequestMessage(1, 16384, 16384),
+		NewPieceMessage(2, 0, nil),
+		NewPieceMessage(2, 16384, []byte("block")),
+		NewCancelMessage(3, 0, 16384),
+	}
+
+	for _, want := range msgs {
+		// Skip the length prefix
+		got, err := FromBytes(want.ToBytes()[4:])
+		if err != nil {
+			t.Fatalf("%T: %v", want, err)
+		}
+		if got.Type() != want.Type() || string(got.ToBytes()) != string(want.ToBytes()) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package messages
+
+type NotInterestedMessage struct {
+}
+
+func NewNotInterestedMessage() *NotInterestedMessage {
+	return &NotInterestedMessage{}
+}
+
+func FromBytesNotInterestedMessage() *NotInterestedMessage {
+	return &NotInterestedMessage{}
+}
+
+func (msg *NotInterestedMessage) Type() int {
+	return NOT_INTERESTED
+}
+
+func (msg *NotInterestedMessage) ToBytes() []byte {
+	return []byte{0, 0, 0, 1, NOT_INTERESTED}
+}
@@ -36,6 +36,7 @@ func (msg *PieceMessage) ToBytes() []byte {
 	a := make([]byte, 4)
 
 	binary.BigEndian.PutUint32(a, uint32(9+len(msg.Block))) // Message Length
+	b.Write(a)
 
 	b.WriteByte(PIECE) // Message id
 
@@ -0,0 +1,325 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// EncryptionPolicy tells whether peer connections are obfuscated with
+// Message Stream Encryption, which hides the BitTorrent protocol from
+// traffic shaping.
+type EncryptionPolicy int
+
+const (
+	// Encrypt when the peer supports it and talk plaintext otherwise.
+	EncryptionPrefer EncryptionPolicy = iota
+	// Only talk to peers that encrypt the whole connection.
+	EncryptionRequire
+	// Never encrypt, peers that insist on it are refused.
+	EncryptionDisable
+)
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	case EncryptionDisable:
+		return "disable"
+	default:
+		return fmt.Sprintf("EncryptionPolicy(%d)", int(p))
+	}
+}
+
+const (
+	// Length of the Diffie-Hellman public keys
+	mseKeyLen = 96
+	// Longest random padding of the handshake
+	mseMaxPad = 512
+	// Crypto methods in crypto_provide and crypto_select
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+var (
+	mseP, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+	// Verification constant, whose encryption marks the end of the
+	// padding
+	mseVC = make([]byte, 8)
+)
+
+// wrappedConn is a connection whose reads and writes go through other
+// streams, e.g. to decrypt them or to replay bytes already buffered.
+type wrappedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *wrappedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *wrappedConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// isPlaintextHandshake reports whether head, the first 20 bytes sent by a
+// peer, start a regular BitTorrent handshake.
+func isPlaintextHandshake(head []byte) bool {
+	return int(head[0]) == len(protocolName) && string(head[1:20]) == protocolName
+}
+
+// mseInitiate encrypts a connection we opened to a peer of the swarm of
+// infoHash. provide holds the crypto methods we accept, the peer picks one.
+func mseInitiate(conn net.Conn, infoHash []byte, provide uint32) (net.Conn, error) {
+	priv, pub, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(pub, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	peerPub := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, peerPub); err != nil {
+		return nil, err
+	}
+
+	s := mseSecret(priv, peerPub)
+	enc := mseCipher("keyA", s, infoHash)
+	dec := mseCipher("keyB", s, infoHash)
+
+	var req bytes.Buffer
+	req.Write(mseHash([]byte("req1"), s))
+	req2 := mseHash([]byte("req2"), infoHash)
+	for i, b := range mseHash([]byte("req3"), s) {
+		req.WriteByte(req2[i] ^ b)
+	}
+	// VC, crypto_provide, no PadC and no initial payload
+	plain := make([]byte, 16)
+	binary.BigEndian.PutUint32(plain[8:], provide)
+	enc.XORKeyStream(plain, plain)
+	req.Write(plain)
+
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// The encrypted VC ends the padding of the peer
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err := mseSync(r, vc, mseMaxPad+len(vc)); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(reply, reply)
+
+	padLen := int(binary.BigEndian.Uint16(reply[4:]))
+	if padLen > mseMaxPad {
+		return nil, fmt.Errorf("padding of %d bytes is too long", padLen)
+	}
+	pad := make([]byte, padLen)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(pad, pad)
+
+	switch selected := binary.BigEndian.Uint32(reply); {
+	case selected&provide == 0 || selected&(selected-1) != 0:
+		return nil, fmt.Errorf("peer selected crypto method %#x", selected)
+	case selected == cryptoRC4:
+		return &wrappedConn{
+			Conn: conn,
+			r:    cipher.StreamReader{S: dec, R: r},
+			w:    cipher.StreamWriter{S: enc, W: conn},
+		}, nil
+	default:
+		return &wrappedConn{Conn: conn, r: r, w: conn}, nil
+	}
+}
+
+// mseReceive answers the encryption handshake of a peer that connected to
+// us, whose first bytes are buffered in r. skeys are the info hashes of the
+// swarms we take part in, the peer must ask for one of them. The returned
+// connection starts with the initial payload of the peer, normally its
+// BitTorrent handshake.
+func mseReceive(conn net.Conn, r *bufio.Reader, skeys []InfoHash, policy EncryptionPolicy) (net.Conn, error) {
+	peerPub := make([]byte, mseKeyLen)
+	if _, err := io.ReadFull(r, peerPub); err != nil {
+		return nil, err
+	}
+
+	priv, pub, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(pub, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	s := mseSecret(priv, peerPub)
+	if err := mseSync(r, mseHash([]byte("req1"), s), mseMaxPad+sha1.Size); err != nil {
+		return nil, err
+	}
+
+	// HASH('req2', SKEY) xor HASH('req3', S) tells the swarm
+	req := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, req); err != nil {
+		return nil, err
+	}
+	for i, b := range mseHash([]byte("req3"), s) {
+		req[i] ^= b
+	}
+	var skey []byte
+	for _, h := range skeys {
+		if bytes.Equal(mseHash([]byte("req2"), h[:]), req) {
+			skey = h[:]
+			break
+		}
+	}
+	if skey == nil {
+		return nil, errors.New("peer asked for unknown torrent")
+	}
+
+	dec := mseCipher("keyA", s, skey)
+	enc := mseCipher("keyB", s, skey)
+
+	head := make([]byte, 14)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(head, head)
+	if !bytes.Equal(head[:8], mseVC) {
+		return nil, errors.New("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(head[8:])
+
+	padLen := int(binary.BigEndian.Uint16(head[12:]))
+	if padLen > mseMaxPad {
+		return nil, fmt.Errorf("padding of %d bytes is too long", padLen)
+	}
+	// PadC followed by the length of the initial payload
+	padC := make([]byte, padLen+2)
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(padC, padC)
+
+	ia := make([]byte, binary.BigEndian.Uint16(padC[padLen:]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != EncryptionRequire:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("no acceptable crypto method in %#x", provide)
+	}
+
+	// VC, crypto_select and no PadD
+	reply := make([]byte, 14)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoRC4 {
+		return &wrappedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(ia), cipher.StreamReader{S: dec, R: r}),
+			w:    cipher.StreamWriter{S: enc, W: conn},
+		}, nil
+	}
+
+	return &wrappedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), r), w: conn}, nil
+}
+
+// mseSync reads from r up to and including mark, which must be found within
+// the next limit bytes.
+func mseSync(r *bufio.Reader, mark []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, mark) {
+			return nil
+		}
+	}
+
+	return errors.New("encryption handshake out of sync")
+}
+
+func mseKeyPair() (priv *big.Int, pub []byte, err error) {
+	x := make([]byte, 20)
+	if _, err := rand.Read(x); err != nil {
+		return nil, nil, err
+	}
+
+	priv = new(big.Int).SetBytes(x)
+	pub = new(big.Int).Exp(mseG, priv, mseP).FillBytes(make([]byte, mseKeyLen))
+	return priv, pub, nil
+}
+
+// mseSecret returns the secret shared with the owner of peerPub.
+func mseSecret(priv *big.Int, peerPub []byte) []byte {
+	y := new(big.Int).SetBytes(peerPub)
+	return new(big.Int).Exp(y, priv, mseP).FillBytes(make([]byte, mseKeyLen))
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher returns the RC4 stream of one direction of the connection, with
+// the first 1 KiB of it discarded.
+func mseCipher(key string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(key), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// msePad returns up to mseMaxPad random bytes.
+func msePad() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(mseMaxPad+1))
+	rand.Read(pad)
+	return pad
+}
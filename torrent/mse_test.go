@@ -0,0 +1,184 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// encrypted reports whether conn is an RC4 encrypted connection.
+func encrypted(conn net.Conn) bool {
+	wc, ok := conn.(*wrappedConn)
+	if !ok {
+		return false
+	}
+	_, ok = wc.w.(cipher.StreamWriter)
+	return ok
+}
+
+func TestMSERoundTrip(t *testing.T) {
+	infoHash := InfoHash{1, 2, 3}
+	tests := []struct {
+		name    string
+		provide uint32
+		policy  EncryptionPolicy
+		rc4     bool
+		fail    bool
+	}{
+		{"rc4", cryptoRC4, EncryptionPrefer, true, false},
+		{"rc4 or plaintext", cryptoRC4 | cryptoPlaintext, EncryptionPrefer, true, false},
+		{"plaintext", cryptoPlaintext, EncryptionPrefer, false, false},
+		{"rc4 required", cryptoRC4, EncryptionRequire, true, false},
+		{"plaintext refused", cryptoPlaintext, EncryptionRequire, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+
+			type result struct {
+				conn net.Conn
+				err  error
+			}
+			received := make(chan result, 1)
+			go func() {
+				conn, err := mseReceive(server, bufio.NewReader(server), []InfoHash{{9}, infoHash}, tt.policy)
+				if err != nil {
+					server.Close()
+				}
+				received <- result{conn, err}
+			}()
+
+			conn, err := mseInitiate(client, infoHash[:], tt.provide)
+			r := <-received
+			if tt.fail {
+				if err == nil || r.err == nil {
+					t.Fatalf("initiate err = %v, receive err = %v, want both to fail", err, r.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			defer r.conn.Close()
+
+			if encrypted(conn) != tt.rc4 || encrypted(r.conn) != tt.rc4 {
+				t.Fatalf("encrypted = %t, %t, want %t", encrypted(conn), encrypted(r.conn), tt.rc4)
+			}
+
+			// Both directions must decrypt what the other side encrypts
+			go conn.Write([]byte("ping"))
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(r.conn, buf); err != nil || string(buf) != "ping" {
+				t.Fatalf("received %q, %v, want \"ping\"", buf, err)
+			}
+			go r.conn.Write([]byte("pong"))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+				t.Fatalf("received %q, %v, want \"pong\"", buf, err)
+			}
+		})
+	}
+}
+
+func TestMSEUnknownTorrent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := mseReceive(server, bufio.NewReader(server), []InfoHash{{9}}, EncryptionPrefer)
+		server.Close()
+		errs <- err
+	}()
+
+	if _, err := mseInitiate(client, []byte{1, 2, 3}, cryptoRC4); err == nil {
+		t.Error("handshake for an unknown torrent succeeded")
+	}
+	if err := <-errs; err == nil {
+		t.Error("unknown torrent accepted")
+	}
+}
+
+// TestHandshakeEncryptionPolicies runs PeerConn.Handshake against the
+// inbound side of a session for every pair of policies.
+func TestHandshakeEncryptionPolicies(t *testing.T) {
+	infoHash := InfoHash{1, 2, 3}
+	tests := []struct {
+		ours, theirs EncryptionPolicy
+		rc4          bool
+		// Connections opened, two when falling back to plaintext
+		dials int
+		err   error
+	}{
+		{EncryptionPrefer, EncryptionPrefer, true, 1, nil},
+		{EncryptionPrefer, EncryptionRequire, true, 1, nil},
+		{EncryptionPrefer, EncryptionDisable, false, 2, nil},
+		{EncryptionRequire, EncryptionPrefer, true, 1, nil},
+		{EncryptionRequire, EncryptionRequire, true, 1, nil},
+		{EncryptionRequire, EncryptionDisable, false, 1, errEncryptionFailed},
+		{EncryptionDisable, EncryptionPrefer, false, 1, nil},
+		{EncryptionDisable, EncryptionRequire, false, 1, io.EOF},
+		{EncryptionDisable, EncryptionDisable, false, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ours.String()+"/"+tt.theirs.String(), func(t *testing.T) {
+			s := &Session{
+				cfg:    SessionConfig{Encryption: tt.theirs},
+				swarms: map[InfoHash]*Torrent{infoHash: nil},
+			}
+
+			var dials atomic.Int32
+			pc := NewPeerConn(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}, 16*1024)
+			pc.encryption = tt.ours
+			pc.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+				dials.Add(1)
+				client, server := net.Pipe()
+				go answerHandshake(s, server)
+				return client, nil
+			}
+
+			err := pc.Handshake(context.Background(), infoHash[:])
+			defer pc.Close()
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case encrypted(pc.conn) != tt.rc4:
+				t.Errorf("encrypted = %t, want %t", encrypted(pc.conn), tt.rc4)
+			}
+			if n := int(dials.Load()); n != tt.dials {
+				t.Errorf("dialed %d times, want %d", n, tt.dials)
+			}
+		})
+	}
+}
+
+// answerHandshake answers a peer that connected to s like the session does,
+// closing the connection when the encryption policy refuses the peer.
+func answerHandshake(s *Session, conn net.Conn) {
+	decrypted, err := s.decrypt(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	infoHash, _, err := readHandshake(decrypted)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	writeHandshake(decrypted, infoHash, false)
+}
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// partFile holds the parts of pieces that fall into skipped files, so that
+// the pieces overlapping the files we want can be verified without creating
+// the skipped ones. Pieces get slots of one piece length each, after a
+// header mapping every piece to its slot.
+type partFile struct {
+	path        string
+	pieceLength int64
+	numPieces   int
+
+	mu sync.Mutex
+	// Slot of every piece plus one, 0 when the piece has none
+	slots  []uint32
+	used   uint32
+	loaded bool
+}
+
+func newPartFile(path string, pieceLength int64, numPieces int) *partFile {
+	return &partFile{
+		path:        path,
+		pieceLength: pieceLength,
+		numPieces:   numPieces,
+	}
+}
+
+// load reads the header of an existing partfile. pf.mu must be held.
+func (pf *partFile) load() error {
+	if pf.loaded {
+		return nil
+	}
+
+	pf.slots = make([]uint32, pf.numPieces)
+	fd, err := os.Open(pf.path)
+	if os.IsNotExist(err) {
+		pf.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	header := make([]byte, 4*pf.numPieces)
+	if _, err := io.ReadFull(fd, header); err != nil {
+		return err
+	}
+	for i := range pf.slots {
+		pf.slots[i] = binary.BigEndian.Uint32(header[4*i:])
+		pf.used = max(pf.used, pf.slots[i])
+	}
+
+	pf.loaded = true
+	return nil
+}
+
+// writeAt saves b, which starts at the torrent-wide offset off.
+func (pf *partFile) writeAt(b []byte, off int64) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if err := pf.load(); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(pf.path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return pf.each(b, off, func(idx int, chunk []byte, pieceOff int64) error {
+		if pf.slots[idx] == 0 {
+			pf.used++
+			pf.slots[idx] = pf.used
+
+			var entry [4]byte
+			binary.BigEndian.PutUint32(entry[:], pf.used)
+			if _, err := fd.WriteAt(entry[:], 4*int64(idx)); err != nil {
+				return err
+			}
+		}
+
+		_, err := fd.WriteAt(chunk, pf.offset(idx)+pieceOff)
+		return err
+	})
+}
+
+// readAt reads len(b) bytes starting at the torrent-wide offset off, which
+// must all have been saved.
+func (pf *partFile) readAt(b []byte, off int64) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if err := pf.load(); err != nil {
+		return err
+	}
+
+	fd, err := os.Open(pf.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	return pf.each(b, off, func(idx int, chunk []byte, pieceOff int64) error {
+		if pf.slots[idx] == 0 {
+			return io.ErrUnexpectedEOF
+		}
+
+		_, err := fd.ReadAt(chunk, pf.offset(idx)+pieceOff)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// has reports whether parts of the piece at idx were saved.
+func (pf *partFile) has(idx int) bool {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	return pf.load() == nil && pf.slots[idx] != 0
+}
+
+func (pf *partFile) remove() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	pf.slots = nil
+	pf.used = 0
+	pf.loaded = false
+
+	err := os.Remove(pf.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// offset returns where the slot of the piece at idx starts in the file.
+// pf.mu must be held.
+func (pf *partFile) offset(idx int) int64 {
+	return 4*int64(pf.numPieces) + int64(pf.slots[idx]-1)*pf.pieceLength
+}
+
+// each splits b, which starts at the torrent-wide offset off, into the
+// chunks that fall into each piece.
+func (pf *partFile) each(b []byte, off int64, fn func(idx int, chunk []byte, pieceOff int64) error) error {
+	for len(b) > 0 {
+		idx := off / pf.pieceLength
+		pieceOff := off % pf.pieceLength
+		n := min(pf.pieceLength-pieceOff, int64(len(b)))
+
+		if err := fn(int(idx), b[:n], pieceOff); err != nil {
+			return err
+		}
+
+		b = b[n:]
+		off += n
+	}
+
+	return nil
+}
@@ -2,20 +2,52 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/joaovictorsl/mytorrent/torrent/messages"
 )
 
+const (
+	protocolName = "BitTorrent protocol"
+	// 1 + len(protocolName) + 8 reserved bytes + 20 info hash + 20 peer id
+	handshakeLen = 68
+	// Largest message we accept from a peer, big enough for a block plus
+	// headers and for bitfields of torrents with millions of pieces.
+	maxMessageLen = 1 << 20
+	// How long a peer may take to accept the connection and to complete the
+	// handshakes
+	handshakeTimeout = 20 * time.Second // TODO: Make this timeout configurable
+	// Bit of the last reserved byte of the handshake set by peers speaking
+	// the v2 protocol (BEP 52)
+	reservedV2 = 0x10
+)
+
 type PeerConn struct {
 	addr         net.Addr
 	conn         net.Conn
 	msgLengthBuf []byte
 	payloadBuf   []byte
 	pieceLen     uint32
+	// Whether Handshake encrypts the connection
+	encryption EncryptionPolicy
+	// Connects to the peer, over TCP when nil
+	dial func(ctx context.Context, addr string) (net.Conn, error)
+	// Budgets messages are charged to
+	bw bandwidth
+	// Serializes writes, which may come from the worker and from HAVE
+	// broadcasts of other workers
+	wmu sync.Mutex
+	// Whether we, and the peer, speak the v2 protocol
+	v2     bool
+	peerV2 bool
 }
 
 func NewPeerConn(peerAddr net.Addr, pieceLen uint32) *PeerConn {
@@ -27,42 +59,156 @@ func NewPeerConn(peerAddr net.Addr, pieceLen uint32) *PeerConn {
 	}
 }
 
-func (pc *PeerConn) Handshake(infoHash []byte) error {
-	msgBytes := bytes.NewBuffer(make([]byte, 0))
-	msgBytes.Write([]byte{19})
-	msgBytes.Write([]byte("BitTorrent protocol"))
-	msgBytes.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0})
-	msgBytes.Write(infoHash)
-	msgBytes.Write([]byte{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9}) // TODO: Make this id configurable
+// newPeerConnFrom wraps a connection a peer opened to us whose handshake has
+// already been exchanged.
+func newPeerConnFrom(conn net.Conn, pieceLen uint32) *PeerConn {
+	pc := NewPeerConn(conn.RemoteAddr(), pieceLen)
+	pc.conn = conn
+	return pc
+}
+
+// Handshake connects to the peer and exchanges handshakes, encrypting the
+// connection as the encryption policy asks. Peers refusing encryption are
+// reconnected to in plaintext unless encryption is required.
+func (pc *PeerConn) Handshake(ctx context.Context, infoHash []byte) error {
+	if pc.encryption != EncryptionDisable {
+		provide := uint32(cryptoRC4)
+		if pc.encryption == EncryptionPrefer {
+			provide |= cryptoPlaintext
+		}
 
-	conn, err := net.DialTimeout("tcp", pc.addr.String(), 20*time.Second) // TODO: Make this timeout configurable
+		err := pc.handshake(ctx, infoHash, func(conn net.Conn) (net.Conn, error) {
+			return mseInitiate(conn, infoHash, provide)
+		})
+		if !errors.Is(err, errEncryptionFailed) || pc.encryption == EncryptionRequire {
+			return err
+		}
+	}
+
+	return pc.handshake(ctx, infoHash, nil)
+}
+
+func dialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// errEncryptionFailed wraps the errors of the encryption handshake.
+var errEncryptionFailed = errors.New("encryption handshake failed")
+
+// handshake dials the peer and exchanges handshakes, after encrypting the
+// connection with encrypt when it isn't nil.
+func (pc *PeerConn) handshake(ctx context.Context, infoHash []byte, encrypt func(net.Conn) (net.Conn, error)) error {
+	dialCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	dial := pc.dial
+	if dial == nil {
+		dial = dialTCP
+	}
+	conn, err := dial(dialCtx, pc.addr.String())
 	if err != nil {
 		return err
 	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
 
-	_, err = conn.Write(msgBytes.Bytes())
-	if err != nil {
+	if encrypt != nil {
+		encrypted, err := encrypt(conn)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("%w: %w", errEncryptionFailed, err)
+		}
+		conn = encrypted
+	}
+
+	if err := writeHandshake(conn, infoHash, pc.v2); err != nil {
 		conn.Close()
 		return err
 	}
 
-	buf := make([]byte, 1024)
-
-	_, err = conn.Read(buf)
+	remoteHash, peerV2, err := readHandshake(conn)
 	if err != nil {
 		conn.Close()
 		return err
 	}
 
+	if !bytes.Equal(remoteHash, infoHash) {
+		conn.Close()
+		return fmt.Errorf("peer answered with info hash %x", remoteHash)
+	}
+
+	conn.SetDeadline(time.Time{})
 	pc.conn = conn
+	pc.peerV2 = peerV2
 
 	return nil
 }
 
+// writeHandshake writes a handshake for infoHash to w, telling whether we
+// speak the v2 protocol.
+func writeHandshake(w io.Writer, infoHash []byte, v2 bool) error {
+	reserved := []byte{0, 0, 0, 0, 0, 0, 0, 0}
+	if v2 {
+		reserved[7] |= reservedV2
+	}
+
+	msgBytes := bytes.NewBuffer(make([]byte, 0, handshakeLen))
+	msgBytes.Write([]byte{byte(len(protocolName))})
+	msgBytes.Write([]byte(protocolName))
+	msgBytes.Write(reserved)
+	msgBytes.Write(infoHash)
+	msgBytes.Write([]byte{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9}) // TODO: Make this id configurable
+
+	_, err := w.Write(msgBytes.Bytes())
+	return err
+}
+
+// readHandshake reads a handshake from r and returns the info hash it
+// carries, and whether the peer speaks the v2 protocol.
+func readHandshake(r io.Reader) (infoHash []byte, v2 bool, err error) {
+	buf := make([]byte, handshakeLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, false, err
+	}
+
+	if int(buf[0]) != len(protocolName) || string(buf[1:20]) != protocolName {
+		return nil, false, fmt.Errorf("unknown protocol %q", buf[1:20])
+	}
+
+	return buf[28:48], buf[27]&reservedV2 != 0, nil
+}
+
+func (pc *PeerConn) write(b []byte) error {
+	if err := waitN(pc.bw.context(), pc.bw.up, pc.charge(b[4:])); err != nil {
+		return err
+	}
+
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+
+	_, err := pc.conn.Write(b)
+	return err
+}
+
 func (pc *PeerConn) SendInterest() error {
 	req := messages.NewInterestedMessage()
-	_, err := pc.conn.Write(req.ToBytes())
-	return err
+	return pc.write(req.ToBytes())
+}
+
+func (pc *PeerConn) SendChoke() error {
+	return pc.write(messages.NewChokeMessage().ToBytes())
+}
+
+func (pc *PeerConn) SendUnchoke() error {
+	return pc.write(messages.NewUnchokeMessage().ToBytes())
+}
+
+func (pc *PeerConn) SendBitfield(bitfield []byte) error {
+	return pc.write(messages.NewBitfieldMessage(bitfield).ToBytes())
+}
+
+func (pc *PeerConn) SendPiece(idx, begin uint32, block []byte) error {
+	return pc.write(messages.NewPieceMessage(idx, begin, block).ToBytes())
 }
 
 func (pc *PeerConn) SendRequest(idx, begin, pieceLen uint32) error {
@@ -73,40 +219,74 @@ func (pc *PeerConn) SendRequest(idx, begin, pieceLen uint32) error {
 	}
 
 	req := messages.NewRequestMessage(idx, begin, length)
-	_, err := pc.conn.Write(req.ToBytes())
-	return err
+	return pc.write(req.ToBytes())
 }
 
 func (pc *PeerConn) HashMatches(piece []byte, hash []byte) bool {
 	return slices.Compare(calcHash(piece), hash) == 0
 }
 
+func (pc *PeerConn) SendHashRequest(r messages.HashRange) error {
+	return pc.write(messages.NewHashRequestMessage(r).ToBytes())
+}
+
+func (pc *PeerConn) SendHashReject(r messages.HashRange) error {
+	return pc.write(messages.NewHashRejectMessage(r).ToBytes())
+}
+
 func (pc *PeerConn) SendHave(idx uint32) error {
 	msg := messages.NewHaveMessage(idx)
-	_, err := pc.conn.Write(msg.ToBytes())
-	return err
+	return pc.write(msg.ToBytes())
 }
 
 func (pc *PeerConn) ReadMessage() (messages.PeerMessage, error) {
-	if _, err := pc.conn.Read(pc.msgLengthBuf); err != nil {
-		return nil, err
-	}
+	for {
+		if _, err := io.ReadFull(pc.conn, pc.msgLengthBuf); err != nil {
+			return nil, err
+		}
 
-	msgBytes := int(binary.BigEndian.Uint32(pc.msgLengthBuf))
-	bytesRead := 0
+		msgBytes := int(binary.BigEndian.Uint32(pc.msgLengthBuf))
+		if msgBytes == 0 {
+			// Keep-alive
+			if err := waitN(pc.bw.context(), pc.bw.down, pc.charge(nil)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if msgBytes > maxMessageLen {
+			return nil, fmt.Errorf("message of %d bytes is too large", msgBytes)
+		}
+		if msgBytes > len(pc.payloadBuf) {
+			pc.payloadBuf = make([]byte, msgBytes)
+		}
 
-	for bytesRead != msgBytes {
-		n, err := pc.conn.Read(pc.payloadBuf[bytesRead:])
-		if err != nil {
+		if _, err := io.ReadFull(pc.conn, pc.payloadBuf[:msgBytes]); err != nil {
+			return nil, err
+		}
+		if err := waitN(pc.bw.context(), pc.bw.down, pc.charge(pc.payloadBuf[:msgBytes])); err != nil {
 			return nil, err
 		}
 
-		bytesRead += n
+		return messages.FromBytes(pc.payloadBuf[:msgBytes])
 	}
+}
 
-	return messages.FromBytes(pc.payloadBuf)
+// charge returns the number of bytes the message with payload counts for
+// against the budgets: the block of a PIECE message, or the whole message
+// with its length prefix when overhead is counted.
+func (pc *PeerConn) charge(payload []byte) int {
+	if pc.bw.overhead {
+		return 4 + len(payload)
+	}
+	if len(payload) > 9 && payload[0] == messages.PIECE {
+		return len(payload) - 9
+	}
+	return 0
 }
 
 func (pc *PeerConn) Close() error {
+	if pc.conn == nil {
+		return nil
+	}
 	return pc.conn.Close()
 }
@@ -1,78 +1,453 @@
 package torrent
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"slices"
+	"sync"
 	"sync/atomic"
 )
 
 type Piece struct {
-	Idx      uint32
-	Hash     []byte
-	SavePath string
+	Idx uint32
+	// SHA1 hash of the piece, nil for v2 only torrents
+	Hash   []byte
+	Length uint32
+
+	// Root of the merkle subtree of the piece in v2 torrents, nil otherwise
+	rootV2 []byte
+	// Bytes of the piece belonging to the file, the rest is padding
+	lengthV2 uint32
+	// Number of 16 KiB leaves of the subtree
+	leavesV2 int
+	// Pieces root of the file of the piece, and index of the first leaf of
+	// the subtree in the tree of the file
+	fileRootV2  []byte
+	firstLeafV2 uint32
+	// Hashes of the leaves of the subtree sent by the peer, checked against
+	// rootV2, nil when unknown
+	leaves [][32]byte
+}
+
+// verify reports whether data matches every hash of the piece. When the
+// hashes of the leaves are known, every 16 KiB block is checked against its
+// own hash.
+func (p Piece) verify(data []byte) bool {
+	if p.Hash != nil && !bytes.Equal(calcHash(data), p.Hash) {
+		return false
+	}
+	if p.leaves != nil {
+		return len(p.badBlocks(data)) == 0
+	}
+	if p.rootV2 != nil {
+		root := merkleRoot(data[:p.lengthV2], p.leavesV2)
+		return bytes.Equal(root[:], p.rootV2)
+	}
+	return true
+}
+
+// badBlocks returns the indexes of the 16 KiB blocks of data that don't
+// match the hashes of the leaves, nil when these are unknown.
+func (p Piece) badBlocks(data []byte) []int {
+	if p.leaves == nil {
+		return nil
+	}
+
+	bad := []int{}
+	data = data[:p.lengthV2]
+	for i := 0; i*merkleBlockLen < len(data); i++ {
+		block := data[i*merkleBlockLen : min((i+1)*merkleBlockLen, len(data))]
+		if sha256.Sum256(block) != p.leaves[i] {
+			bad = append(bad, i)
+		}
+	}
+	return bad
+}
+
+// withLeaves returns p with the hashes of the leaves of its subtree, 32 bytes
+// each, ok is false when they don't add up to the root of the piece.
+func (p Piece) withLeaves(hashes []byte) (Piece, bool) {
+	if p.rootV2 == nil || len(hashes) != p.leavesV2*32 {
+		return p, false
+	}
+
+	leaves := make([][32]byte, p.leavesV2)
+	for i := range leaves {
+		copy(leaves[i][:], hashes[i*32:])
+	}
+	if root := merkleReduce(leaves, p.leavesV2, [32]byte{}); !bytes.Equal(root[:], p.rootV2) {
+		return p, false
+	}
+
+	p.leaves = leaves
+	return p, true
 }
 
 type PieceManager struct {
 	downloadedPieces atomic.Uint32
+	downloadedBytes  atomic.Int64
 	totalPieces      uint32
-	pieceCh          chan Piece
 	pieces           []Piece
-	done             chan struct{}
+	have             []atomic.Bool
+	// Called for every piece that completes
+	onPiece func(Piece)
+
+	mu sync.Mutex
+	// Pieces waiting for a worker, by priority from FileLow to FileHigh
+	queues [FileHigh][]uint32
+	// Whether the piece waits for a worker, in a queue or skipped
+	idle []bool
+	// Priority of every piece, the highest of the files it overlaps
+	priorities []FilePriority
+	// Pieces not skipped, and how many of them we have
+	wanted     int
+	wantedDone int
+	// Bytes of the pieces not skipped, and how many of them we have
+	wantedBytes     int64
+	wantedBytesDone int64
+	// Closed once every piece not skipped is downloaded
+	done chan struct{}
+	// Closed and replaced whenever a piece completes
+	progress chan struct{}
+	// Ranges of pieces readers wait for or will read soon, by reader. They
+	// are picked before any other piece, whatever their priority.
+	windows    map[int]pieceRange
+	nextWindow int
+
+	// Buffers of the length of the largest piece, for pieces in flight
+	buffers sync.Pool
 }
 
-func NewPieceManager(pieces []string) *PieceManager {
-	pieceCh := make(chan Piece, len(pieces))
+// pieceRange is the range of pieces [first, end).
+type pieceRange struct {
+	first, end uint32
+}
+
+func NewPieceManager(pieces []string, pieceLength, totalLength int) *PieceManager {
+	all := make([]Piece, len(pieces))
 	for i, p := range pieces {
-		pieceCh <- Piece{
-			Idx:      uint32(i),
-			Hash:     []byte(p),
-			SavePath: fmt.Sprintf("piece_%d", i),
+		length := pieceLength
+		if rest := totalLength - i*pieceLength; rest < length {
+			// Last piece may be truncated
+			length = rest
+		}
+
+		all[i] = Piece{
+			Idx:    uint32(i),
+			Hash:   []byte(p),
+			Length: uint32(length),
 		}
 	}
 
-	return &PieceManager{
+	return newPieceManager(all)
+}
+
+func newPieceManager(pieces []Piece) *PieceManager {
+	pm := &PieceManager{
 		downloadedPieces: atomic.Uint32{},
 		totalPieces:      uint32(len(pieces)),
-		pieceCh:          pieceCh,
-		pieces:           make([]Piece, len(pieces)),
+		pieces:           pieces,
+		have:             make([]atomic.Bool, len(pieces)),
+		idle:             make([]bool, len(pieces)),
+		priorities:       make([]FilePriority, len(pieces)),
 		done:             make(chan struct{}),
+		progress:         make(chan struct{}),
+		windows:          make(map[int]pieceRange),
 	}
+	var maxLen uint32
+	for i, p := range pieces {
+		pm.idle[i] = true
+		pm.priorities[i] = FileNormal
+		maxLen = max(maxLen, p.Length)
+	}
+	pm.setPriorities(pm.priorities)
+	pm.buffers.New = func() any {
+		b := make([]byte, maxLen)
+		return &b
+	}
+
+	return pm
+}
+
+// buffer returns a buffer large enough for any piece, to be handed back
+// through putBuffer once done with.
+func (pm *PieceManager) buffer() []byte {
+	return *pm.buffers.Get().(*[]byte)
+}
+
+func (pm *PieceManager) putBuffer(b []byte) {
+	b = b[:cap(b)]
+	pm.buffers.Put(&b)
 }
 
+// Notify marks p as downloaded and verified. Notifying the same piece more
+// than once has no effect.
 func (pm *PieceManager) Notify(p Piece) {
-	downloadedPieces := pm.downloadedPieces.Add(1)
+	pm.mu.Lock()
+	// Marked under pm.mu, so that setPriorities counts the piece either
+	// before or after us but never twice
+	if pm.have[p.Idx].Swap(true) {
+		pm.mu.Unlock()
+		return
+	}
 
-	pm.presentProgress(downloadedPieces)
+	pm.downloadedBytes.Add(int64(p.Length))
+	pm.downloadedPieces.Add(1)
 
-	if downloadedPieces == pm.totalPieces {
-		pm.done <- struct{}{}
+	close(pm.progress)
+	pm.progress = make(chan struct{})
+
+	if pm.priorities[p.Idx] != FileSkip {
+		pm.wantedDone++
+		pm.wantedBytesDone += int64(p.Length)
+		pm.checkDone()
 	}
+	pm.mu.Unlock()
 
-	pm.pieces[p.Idx] = p
+	if pm.onPiece != nil {
+		pm.onPiece(p)
+	}
 }
 
-func (pm *PieceManager) presentProgress(progress uint32) {
-	fmt.Printf("\r%.2f%%", (float32(progress)/float32(pm.totalPieces))*100)
+// setPriorities changes the priority of every piece. Skipped pieces are not
+// handed to workers and the download completes without them. It reports
+// whether a completed download has pieces to download again.
+func (pm *PieceManager) setPriorities(priorities []FilePriority) (reopened bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.priorities = priorities
+	pm.wanted, pm.wantedDone = 0, 0
+	pm.wantedBytes, pm.wantedBytesDone = 0, 0
+	for i := range pm.queues {
+		pm.queues[i] = pm.queues[i][:0]
+	}
+
+	for i, p := range pm.pieces {
+		prio := priorities[i]
+		if prio == FileSkip {
+			continue
+		}
+
+		pm.wanted++
+		pm.wantedBytes += int64(p.Length)
+		if pm.have[i].Load() {
+			pm.wantedDone++
+			pm.wantedBytesDone += int64(p.Length)
+		} else if pm.idle[i] {
+			pm.queues[prio-FileLow] = append(pm.queues[prio-FileLow], uint32(i))
+		}
+	}
+
+	select {
+	case <-pm.done:
+		if pm.wantedDone < pm.wanted {
+			pm.done = make(chan struct{})
+			return true
+		}
+	default:
+		pm.checkDone()
+	}
+
+	return false
 }
 
-// func (pm *PieceManager) assemblyFile() {
-// 	f, err := os.OpenFile("complete", os.O_CREATE|os.O_WRONLY, 0666)
-// 	if err != nil {
-// 		panic(err)
-// 	}
-// 	defer f.Close()
+// checkDone closes done once every piece not skipped is downloaded. pm.mu
+// must be held.
+func (pm *PieceManager) checkDone() {
+	if pm.wantedDone < pm.wanted {
+		return
+	}
 
-// 	begin := int64(0)
-// 	var b []byte
-// 	for _, p := range pm.pieces {
-// 		b, err = os.ReadFile(p.SavePath)
-// 		if err != nil {
-// 			panic(err)
-// 		}
+	select {
+	case <-pm.done:
+	default:
+		close(pm.done)
+	}
+}
 
-// 		f.WriteAt(b, begin)
+// complete reports whether every piece not skipped is downloaded.
+func (pm *PieceManager) complete() bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.wantedDone >= pm.wanted
+}
 
-// 		os.Remove(p.SavePath)
-// 	}
+// wants reports whether the piece at idx still has to be downloaded.
+func (pm *PieceManager) wants(idx uint32) bool {
+	if pm.Has(idx) {
+		return false
+	}
 
-// 	pm.done <- struct{}{}
-// }
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.priorities[idx] != FileSkip
+}
+
+// wantedProgress returns the bytes of the pieces not skipped and how many of
+// them are downloaded.
+func (pm *PieceManager) wantedProgress() (total, done int64) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.wantedBytes, pm.wantedBytesDone
+}
+
+// Has reports whether the piece at idx was downloaded and verified.
+func (pm *PieceManager) Has(idx uint32) bool {
+	return idx < pm.totalPieces && pm.have[idx].Load()
+}
+
+// Bitfield returns the pieces we have in the format of the BITFIELD
+// message.
+func (pm *PieceManager) Bitfield() []byte {
+	b := make([]byte, (pm.totalPieces+7)/8)
+	for i := range pm.have {
+		if pm.have[i].Load() {
+			b[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return b
+}
+
+// nextPiece returns a piece that still has to be downloaded and for which
+// peerHas returns true, without blocking. Pieces readers need come first,
+// then the pieces of the files with the highest priority, in order. The
+// piece must be handed back with putBack unless it is downloaded.
+func (pm *PieceManager) nextPiece(peerHas func(idx uint32) bool) (Piece, bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if p, ok := pm.nextInWindows(peerHas); ok {
+		return p, true
+	}
+
+	for prio := len(pm.queues) - 1; prio >= 0; prio-- {
+		queue := pm.queues[prio]
+		for i := 0; i < len(queue); i++ {
+			idx := queue[i]
+			if pm.have[idx].Load() || !pm.idle[idx] {
+				// Verified while it was waiting in the queue, or picked
+				// for a reader
+				queue = append(queue[:i], queue[i+1:]...)
+				pm.idle[idx] = false
+				i--
+				continue
+			}
+			if !peerHas(idx) {
+				continue
+			}
+
+			pm.queues[prio] = append(queue[:i], queue[i+1:]...)
+			pm.idle[idx] = false
+			return pm.pieces[idx], true
+		}
+		pm.queues[prio] = queue
+	}
+
+	return Piece{}, false
+}
+
+// nextInWindows picks the first piece of the reader windows closest to the
+// start of their window. pm.mu must be held.
+func (pm *PieceManager) nextInWindows(peerHas func(idx uint32) bool) (Piece, bool) {
+	for dist := uint32(0); ; dist++ {
+		inRange := false
+		for _, w := range pm.windows {
+			idx := w.first + dist
+			if idx >= w.end {
+				continue
+			}
+			inRange = true
+			if pm.idle[idx] && !pm.have[idx].Load() && peerHas(idx) {
+				pm.idle[idx] = false
+				return pm.pieces[idx], true
+			}
+		}
+		if !inRange {
+			return Piece{}, false
+		}
+	}
+}
+
+// putBack queues p again after a worker failed to download it.
+func (pm *PieceManager) putBack(p Piece) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.idle[p.Idx] || pm.have[p.Idx].Load() {
+		return
+	}
+
+	pm.idle[p.Idx] = true
+	if prio := pm.priorities[p.Idx]; prio != FileSkip {
+		// Keep the queue in order
+		queue := pm.queues[prio-FileLow]
+		i, _ := slices.BinarySearch(queue, p.Idx)
+		pm.queues[prio-FileLow] = slices.Insert(queue, i, p.Idx)
+	}
+}
+
+// setWindow makes the pieces [first, end) the most urgent ones for the
+// reader id.
+func (pm *PieceManager) setWindow(id int, first, end uint32) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.windows[id] = pieceRange{first, min(end, pm.totalPieces)}
+}
+
+// newWindow returns the id of a new reader, whose window is empty.
+func (pm *PieceManager) newWindow() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.nextWindow++
+	return pm.nextWindow
+}
+
+func (pm *PieceManager) removeWindow(id int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	delete(pm.windows, id)
+}
+
+// waitPiece blocks until the piece at idx is downloaded or ctx is done.
+func (pm *PieceManager) waitPiece(ctx context.Context, idx uint32) error {
+	for {
+		pm.mu.Lock()
+		progress := pm.progress
+		pm.mu.Unlock()
+
+		if pm.Has(idx) {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Done is closed once every piece not skipped has been downloaded. Pieces
+// that are no longer skipped afterwards make it return a new channel.
+func (pm *PieceManager) Done() <-chan struct{} {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.done
+}
+
+func (pm *PieceManager) DownloadedPieces() uint32 {
+	return pm.downloadedPieces.Load()
+}
+
+func (pm *PieceManager) DownloadedBytes() int64 {
+	return pm.downloadedBytes.Load()
+}
+
+func (pm *PieceManager) TotalPieces() uint32 {
+	return pm.totalPieces
+}
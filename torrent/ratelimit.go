@@ -0,0 +1,184 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every connection that draws from
+// the same bandwidth budget. A rate of 0 disables limiting.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// Closed and replaced whenever the rate changes, so that transfers
+	// waiting for tokens pay for them at the new rate
+	changed chan struct{}
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(bytesPerSec),
+		tokens:  float64(bytesPerSec),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Rate returns the budget in bytes per second, 0 when unlimited.
+func (l *rateLimiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.rate)
+}
+
+// SetRate changes the budget, taking effect for the bytes transferred from
+// now on. 0 disables limiting.
+func (l *rateLimiter) SetRate(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(bytesPerSec) == l.rate {
+		return
+	}
+
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		l.tokens = float64(bytesPerSec)
+	}
+	l.rate = float64(bytesPerSec)
+	l.tokens = min(l.tokens, l.rate)
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// reserve takes n tokens from the bucket and returns how long to wait until
+// the bucket has refilled enough to pay for them, along with a channel
+// closed if the rate changes meanwhile.
+func (l *rateLimiter) reserve(n int) (time.Duration, <-chan struct{}) {
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0, l.changed
+	}
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, l.changed
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), l.changed
+}
+
+// refund gives back n tokens taken by reserve and not used.
+func (l *rateLimiter) refund(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate > 0 {
+		l.tokens = min(l.tokens+float64(n), l.rate)
+	}
+}
+
+// refill adds the tokens earned since the last call. l.mu must be held.
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		// Never accumulate more than one second worth of burst
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// waitN takes n tokens from every limiter, waiting until the most
+// constrained one has refilled enough to pay for them. The tokens are given
+// back when ctx is done first, or to reserve them again when the rate of
+// the most constrained limiter changes.
+func waitN(ctx context.Context, limiters []*rateLimiter, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	for {
+		var wait time.Duration
+		var changed <-chan struct{}
+		for _, l := range limiters {
+			if d, ch := l.reserve(n); d > wait {
+				wait, changed = d, ch
+			}
+		}
+		if wait == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+		case <-changed:
+		}
+		timer.Stop()
+
+		for _, l := range limiters {
+			l.refund(n)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// bandwidth holds the budgets a transfer draws from, e.g. those of the
+// session, of the torrent and of the peer.
+type bandwidth struct {
+	down []*rateLimiter
+	up   []*rateLimiter
+	// Charge whole messages to the budgets instead of only the blocks of
+	// content they carry
+	overhead bool
+	// Gives up waiting for the budgets once done, nil waits until paid
+	ctx context.Context
+}
+
+// context returns the context waits for the budgets give up on.
+func (bw bandwidth) context() context.Context {
+	if bw.ctx == nil {
+		return context.Background()
+	}
+	return bw.ctx
+}
+
+// limitedReader charges every byte read from the wrapped reader to
+// limiters.
+type limitedReader struct {
+	io.Reader
+	down []*rateLimiter
+	ctx  context.Context
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if waitErr := waitN(r.ctx, r.down, n); waitErr != nil {
+		return n, waitErr
+	}
+	return n, err
+}
@@ -0,0 +1,53 @@
+package torrent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSetRateWakesOwnWaiters(t *testing.T) {
+	a, b := newRateLimiter(1000), newRateLimiter(1000)
+	_, changed := a.reserve(0)
+
+	b.SetRate(2000)
+	if closed(changed) {
+		t.Fatal("rate change of another limiter woke the waiters")
+	}
+	a.SetRate(1000)
+	if closed(changed) {
+		t.Fatal("setting the same rate woke the waiters")
+	}
+	a.SetRate(2000)
+	if !closed(changed) {
+		t.Fatal("rate change didn't wake the waiters")
+	}
+}
+
+func TestWaitNRateChange(t *testing.T) {
+	l := newRateLimiter(1000)
+	done := make(chan error, 1)
+	// Ten seconds past the burst
+	go func() { done <- waitN(context.Background(), []*rateLimiter{l, newRateLimiter(0)}, 11000) }()
+
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait not cut short by lifting the limit")
+	}
+}
@@ -0,0 +1,206 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Bytes ahead of the read position downloaded first by default
+const defaultReadahead = 5 << 20
+
+// ErrNotRunning is returned by reads of pieces that won't be downloaded
+// because the torrent stopped.
+var ErrNotRunning = errors.New("torrent is not running")
+
+// FileReader reads a file of a torrent while it downloads, which makes it
+// possible to start playing media right away. Reads block until the pieces
+// they need are verified, and the pieces from the read position up to the
+// readahead are downloaded before any other. Reads of skipped files are
+// served as well, but only while the torrent is running.
+//
+// A FileReader is not safe for concurrent use.
+type FileReader struct {
+	t         *Torrent
+	file      storageFile
+	window    int
+	pos       int64
+	readahead int64
+	ctx       context.Context
+	close     context.CancelCauseFunc
+}
+
+// NewReader returns a reader of the file at idx in Files. It must be closed
+// once done with, so that its pieces are no longer favoured.
+func (t *Torrent) NewReader(idx int) (*FileReader, error) {
+	return t.NewReaderContext(context.Background(), idx)
+}
+
+// NewReaderContext is NewReader with reads giving up once ctx is done.
+func (t *Torrent) NewReaderContext(ctx context.Context, idx int) (*FileReader, error) {
+	var files []storageFile
+	for _, f := range t.storage.files {
+		if !f.pad {
+			files = append(files, f)
+		}
+	}
+	if idx < 0 || idx >= len(files) {
+		return nil, fmt.Errorf("file %d out of range [0, %d)", idx, len(files))
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &FileReader{
+		t:         t,
+		file:      files[idx],
+		window:    t.pm.newWindow(),
+		readahead: defaultReadahead,
+		ctx:       ctx,
+		close:     cancel,
+	}, nil
+}
+
+// SetReadahead changes how many bytes ahead of the read position are
+// downloaded first.
+func (r *FileReader) SetReadahead(n int64) {
+	r.readahead = max(n, 0)
+	if r.pos < r.file.length {
+		r.updateWindow()
+	}
+}
+
+func (r *FileReader) Read(b []byte) (int, error) {
+	return r.ReadContext(context.Background(), b)
+}
+
+// ReadContext is Read giving up waiting for pieces when ctx is done. Reads
+// of pieces not downloaded fail with ErrNotRunning once the torrent is
+// paused, completed, failed or removed.
+func (r *FileReader) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	if r.pos >= r.file.length {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	off := r.file.offset + r.pos
+	idx := uint32(off / r.t.storage.pieceLength)
+	pieceEnd := (int64(idx) + 1) * r.t.storage.pieceLength
+	n := min(int64(len(b)), r.file.offset+r.file.length-off, pieceEnd-off)
+
+	r.updateWindow()
+
+	ctx, stop := mergeCancel(ctx, r.ctx)
+	defer stop()
+	if err := r.waitPiece(ctx, idx); err != nil {
+		if r.ctx.Err() != nil {
+			// Closed while the window was being set
+			r.t.pm.removeWindow(r.window)
+			return 0, context.Cause(r.ctx)
+		}
+		return 0, err
+	}
+
+	if err := r.t.storage.readAt(b[:n], off); err != nil {
+		return 0, err
+	}
+
+	r.pos += n
+	return int(n), nil
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.file.length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+// waitPiece waits for the piece at idx while the torrent may still
+// download it.
+func (r *FileReader) waitPiece(ctx context.Context, idx uint32) error {
+	for {
+		changed := r.t.stateChanges()
+		switch r.t.State() {
+		case StatePaused, StateCompleted, StateError:
+			if r.t.pm.Has(idx) {
+				return nil
+			}
+			return ErrNotRunning
+		}
+
+		// Look at the state again once it changes
+		waitCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-changed:
+				cancel()
+			case <-waitCtx.Done():
+			}
+		}()
+		err := r.t.pm.waitPiece(waitCtx, idx)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// Close stops favouring the pieces of the reader and unblocks its reads.
+func (r *FileReader) Close() error {
+	r.close(os.ErrClosed)
+	r.t.pm.removeWindow(r.window)
+	return nil
+}
+
+// complete reports whether every piece of the file is downloaded.
+func (r *FileReader) complete() bool {
+	if r.file.length == 0 {
+		return true
+	}
+
+	pieceLength := r.t.storage.pieceLength
+	last := uint32((r.file.offset + r.file.length - 1) / pieceLength)
+	for idx := uint32(r.file.offset / pieceLength); idx <= last; idx++ {
+		if !r.t.pm.Has(idx) {
+			return false
+		}
+	}
+	return true
+}
+
+// updateWindow favours the pieces from the read position up to the
+// readahead.
+func (r *FileReader) updateWindow() {
+	pieceLength := r.t.storage.pieceLength
+	start := r.file.offset + r.pos
+	end := min(start+max(r.readahead, 1), r.file.offset+r.file.length)
+
+	r.t.pm.setWindow(r.window, uint32(start/pieceLength), uint32((end-1)/pieceLength)+1)
+}
+
+// mergeCancel returns a context done once either a or b is.
+func mergeCancel(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	stop := context.AfterFunc(b, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
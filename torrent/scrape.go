@@ -0,0 +1,173 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/joaovictorsl/bencoding"
+)
+
+// Number of info hashes asked for in a single HTTP scrape, bounded by the
+// length of the URL
+const httpScrapeBatch = 50
+
+var ErrScrapeUnsupported = errors.New("tracker doesn't support scraping")
+
+// ScrapeResult describes the swarm of a torrent as seen by a tracker.
+type ScrapeResult struct {
+	// Peers with the complete content
+	Seeders int
+	// Peers still downloading
+	Leechers int
+	// Number of times a download completed
+	Downloaded int
+}
+
+// Scrape asks the tracker at the announce URL tracker about the swarms of
+// hashes, without joining them. Both HTTP and UDP (BEP 15) trackers are
+// supported. Hashes the tracker doesn't know are left out of the result.
+func (c *Client) Scrape(ctx context.Context, tracker string, hashes []InfoHash) (map[InfoHash]ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[InfoHash]ScrapeResult, len(hashes))
+
+	switch u.Scheme {
+	case "http", "https":
+		scrapeURL, err := scrapeURLFrom(u)
+		if err != nil {
+			return nil, err
+		}
+		for _, batch := range batches(hashes, httpScrapeBatch) {
+			if err := c.scrapeHTTP(ctx, scrapeURL, batch, results); err != nil {
+				return nil, err
+			}
+		}
+	case "udp":
+		for _, batch := range batches(hashes, udpScrapeBatch) {
+			if err := scrapeUDP(ctx, u.Host, batch, results); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+
+	return results, nil
+}
+
+// Scrape asks the tracker of the torrent about its swarm.
+func (t *Torrent) Scrape(ctx context.Context) (ScrapeResult, error) {
+	tracker := t.data.Announce
+	if tracker == "" && len(t.data.AnnounceList) > 0 && len(t.data.AnnounceList[0]) > 0 {
+		tracker = t.data.AnnounceList[0][0]
+	}
+	if tracker == "" {
+		return ScrapeResult{}, errors.New("torrent has no tracker")
+	}
+
+	results, err := t.client.Scrape(ctx, tracker, []InfoHash{t.infoHash})
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+
+	r, ok := results[t.infoHash]
+	if !ok {
+		return r, errors.New("tracker doesn't know the torrent")
+	}
+
+	return r, nil
+}
+
+// scrapeURLFrom derives the scrape URL from an announce URL: the last path
+// component must start with "announce", which is replaced by "scrape".
+func scrapeURLFrom(announce *url.URL) (string, error) {
+	u := *announce
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	u.RawPath = ""
+
+	return u.String(), nil
+}
+
+func (c *Client) scrapeHTTP(ctx context.Context, scrapeURL string, hashes []InfoHash, results map[InfoHash]ScrapeResult) error {
+	params := url.Values{}
+	for _, h := range hashes {
+		params.Add("info_hash", string(h[:]))
+	}
+
+	sep := "?"
+	if strings.Contains(scrapeURL, "?") {
+		sep = "&"
+	}
+
+	res, err := c.getTracker(ctx, scrapeURL+sep+params.Encode())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("scrape: %s", res.Status)
+	}
+
+	data, err := bencoding.DecodeTo[map[string]interface{}](bufio.NewReader(res.Body))
+	if err != nil {
+		return err
+	}
+
+	if reason, ok := data["failure reason"].(string); ok {
+		return &TrackerError{Reason: reason}
+	}
+
+	files, err := getField[map[string]interface{}]("files", data)
+	if err != nil {
+		return err
+	}
+
+	for key, iFile := range files {
+		file, ok := iFile.(map[string]interface{})
+		if len(key) != len(InfoHash{}) || !ok {
+			continue
+		}
+
+		var r ScrapeResult
+		if r.Seeders, _, err = getOptionalField[int]("complete", file); err != nil {
+			return within("files", err)
+		}
+		if r.Leechers, _, err = getOptionalField[int]("incomplete", file); err != nil {
+			return within("files", err)
+		}
+		if r.Downloaded, _, err = getOptionalField[int]("downloaded", file); err != nil {
+			return within("files", err)
+		}
+
+		var h InfoHash
+		copy(h[:], key)
+		results[h] = r
+	}
+
+	return nil
+}
+
+// batches splits hashes into consecutive batches of at most n hashes.
+func batches(hashes []InfoHash, n int) [][]InfoHash {
+	var b [][]InfoHash
+	for len(hashes) > 0 {
+		end := min(n, len(hashes))
+		b = append(b, hashes[:end])
+		hashes = hashes[end:]
+	}
+	return b
+}
@@ -0,0 +1,633 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownTorrent = errors.New("unknown torrent")
+	ErrTorrentExists  = errors.New("torrent already added")
+	ErrSessionClosed  = errors.New("session closed")
+)
+
+type SessionConfig struct {
+	// Address the peer listener shared by every torrent binds to. Without a
+	// host it accepts both IPv4 and IPv6 peers.
+	//
+	// Defaults to ":6881".
+	ListenAddr string
+	// Directory the content of every torrent is saved under.
+	//
+	// Defaults to the working directory.
+	DataDir string
+	// Maximum number of peer connections across all torrents, 0 means
+	// unlimited.
+	MaxConns int
+	// Maximum number of peer connections of a single torrent, 0 means
+	// unlimited.
+	MaxConnsPerTorrent int
+	// Number of peers of each torrent we upload to because they upload the
+	// most to us, or download the most from us when seeding. One more peer
+	// is picked at random every 30 seconds.
+	//
+	// Defaults to 4.
+	UploadSlots int
+	// Maximum number of torrents downloading at the same time, the rest wait
+	// in the queue ordered by priority. 0 means unlimited.
+	MaxActive int
+	// Download budget in bytes per second shared by all torrents, 0 means
+	// unlimited. See Session.SetDownloadRate and Torrent.SetDownloadRate.
+	DownloadRate int
+	// Upload budget in bytes per second shared by all torrents, 0 means
+	// unlimited.
+	UploadRate int
+	// Budgets in bytes per second of every single peer, 0 means unlimited.
+	// See Torrent.SetPeerRates.
+	PeerDownloadRate int
+	PeerUploadRate   int
+	// Charge the headers of peer messages and the messages without content
+	// to the budgets as well, instead of only the blocks of content.
+	CountOverhead bool
+	// Keep torrents uploading to other peers once they complete.
+	Seed bool
+	// Whether peer connections are encrypted, in both directions.
+	//
+	// Defaults to EncryptionPrefer.
+	Encryption EncryptionPolicy
+	// Only connect over TCP. Otherwise peers are also accepted over uTP, on
+	// the UDP port of the same number as the listener, and dialed over uTP
+	// first.
+	DisableUTP bool
+	// Don't look for peers on the local network with Local Service
+	// Discovery. Private torrents never are.
+	DisableLSD bool
+	// Number of goroutines verifying the pieces of every torrent.
+	//
+	// Defaults to one per CPU.
+	HashWorkers int
+	// Memory shared by every torrent for the pieces verified and not
+	// written to disk yet. Downloads slow down while it is full.
+	//
+	// Defaults to 64 MiB.
+	WriteCache int
+	// Memory shared by every torrent for the pieces recently read to upload
+	// them, negative to disable.
+	//
+	// Defaults to 32 MiB.
+	ReadCache int
+	// When the content of torrents is flushed to stable storage.
+	//
+	// Defaults to SyncOnComplete.
+	Sync SyncPolicy
+	// How the files of torrents take up disk space, see
+	// AddOptions.Allocation.
+	//
+	// Defaults to AllocSparse.
+	Allocation AllocationMode
+}
+
+// Session runs many torrents side by side, sharing a single peer listener,
+// connection limits and bandwidth budget between them.
+type Session struct {
+	client   *Client
+	cfg      SessionConfig
+	listener net.Listener
+	// nil when uTP is disabled
+	utp *utpSocket
+	// nil when LSD is disabled or unavailable
+	lsd       *lsd
+	conns     chan struct{}
+	downLimit *rateLimiter
+	upLimit   *rateLimiter
+	events    *eventHub
+	hashes    *hashPool
+	cache     *diskCache
+
+	mu       sync.Mutex
+	torrents map[InfoHash]*Torrent
+	// Torrents by the info hash of every swarm they take part in
+	swarms map[InfoHash]*Torrent
+	seq    uint64
+	closed bool
+}
+
+func NewSession(client *Client, cfg SessionConfig) (*Session, error) {
+	if client == nil {
+		client = &Client{}
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":6881"
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = "."
+	}
+
+	l, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var utp *utpSocket
+	if !cfg.DisableUTP {
+		host, _, _ := net.SplitHostPort(cfg.ListenAddr)
+		port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(host, port))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		utp = newUTPSocket(pc, nil)
+	}
+
+	s := &Session{
+		client:    client,
+		cfg:       cfg,
+		listener:  l,
+		utp:       utp,
+		downLimit: newRateLimiter(cfg.DownloadRate),
+		upLimit:   newRateLimiter(cfg.UploadRate),
+		events:    newEventHub(nil),
+		hashes:    newHashPool(cfg.HashWorkers),
+		cache:     newDiskCache(cfg.WriteCache, cfg.ReadCache),
+		torrents:  make(map[InfoHash]*Torrent),
+		swarms:    make(map[InfoHash]*Torrent),
+	}
+	if cfg.MaxConns > 0 {
+		s.conns = make(chan struct{}, cfg.MaxConns)
+	}
+
+	go s.acceptLoop(l)
+	if utp != nil {
+		go s.acceptLoop(utp)
+	}
+
+	if !cfg.DisableLSD {
+		s.lsd, err = newLSD(l.Addr().(*net.TCPAddr).Port, s.addLocalPeer)
+		if err != nil {
+			client.logger().Warn("local service discovery unavailable", "err", err)
+		} else {
+			go s.lsd.run(s.lsdHashes)
+		}
+	}
+
+	return s, nil
+}
+
+// Add reads a .torrent file from r and queues it for download.
+func (s *Session) Add(r io.Reader) (*Torrent, error) {
+	td, err := s.client.decodeTorrentData(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.AddTorrentData(td)
+}
+
+// AddOptions tune a torrent added to a session before it starts.
+type AddOptions struct {
+	// Priority of every file, in the order of Torrent.Files. nil downloads
+	// every file.
+	FilePriorities []FilePriority
+	// How the files of the torrent take up disk space, instead of
+	// SessionConfig.Allocation.
+	Allocation *AllocationMode
+}
+
+// AddTorrentData queues the torrent described by td for download.
+func (s *Session) AddTorrentData(td *TorrentData) (*Torrent, error) {
+	return s.AddTorrentDataWith(td, AddOptions{})
+}
+
+// AddTorrentDataWith queues the torrent described by td for download, set up
+// by opts.
+func (s *Session) AddTorrentDataWith(td *TorrentData, opts AddOptions) (*Torrent, error) {
+	if err := td.Validate(); err != nil {
+		return nil, err
+	}
+
+	t := newTorrent(s.client, td, s.cfg.DataDir, s.events)
+	addr := s.listener.Addr().(*net.TCPAddr)
+	t.port = addr.Port
+	t.ipv4, t.ipv6 = announceAddrs(addr.IP)
+	t.conns = s.conns
+	t.maxPeers = s.cfg.MaxConnsPerTorrent
+	t.uploadSlots = s.cfg.UploadSlots
+	t.encryption = s.cfg.Encryption
+	if s.utp != nil {
+		t.dial = s.dialPeer
+	}
+	t.seed = s.cfg.Seed
+	t.sessionDown, t.sessionUp = s.downLimit, s.upLimit
+	t.countOverhead = s.cfg.CountOverhead
+	t.SetPeerRates(s.cfg.PeerDownloadRate, s.cfg.PeerUploadRate)
+	t.onStop = s.schedule
+	t.hashes = s.hashes
+	t.storage.cache = s.cache
+	t.storage.syncPolicy = s.cfg.Sync
+	t.storage.allocation = s.cfg.Allocation
+	if opts.Allocation != nil {
+		t.storage.allocation = *opts.Allocation
+	}
+	if opts.FilePriorities != nil {
+		if err := t.SetFilePriorities(opts.FilePriorities); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	for _, hash := range t.swarms {
+		if _, ok := s.swarms[hash]; ok {
+			s.mu.Unlock()
+			return nil, ErrTorrentExists
+		}
+	}
+	s.seq++
+	t.seq = s.seq
+	s.torrents[t.infoHash] = t
+	for _, hash := range t.swarms {
+		s.swarms[hash] = t
+	}
+	s.mu.Unlock()
+
+	s.schedule()
+
+	return t, nil
+}
+
+// HashQueue returns the number of pieces of every torrent waiting for or
+// being verified.
+func (s *Session) HashQueue() int {
+	return s.hashes.depth()
+}
+
+// Get returns the torrent identified by infoHash.
+func (s *Session) Get(infoHash InfoHash) (*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, ErrUnknownTorrent
+	}
+
+	return t, nil
+}
+
+// List returns every torrent of the session in queue order.
+func (s *Session) List() []*Torrent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sorted()
+}
+
+// Remove stops the torrent and forgets about it. When deleteData is true
+// the downloaded content is deleted as well.
+func (s *Session) Remove(infoHash InfoHash, deleteData bool) error {
+	s.mu.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	if ok {
+		for _, hash := range t.swarms {
+			delete(s.swarms, hash)
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrUnknownTorrent
+	}
+
+	t.stop(StatePaused)
+	s.schedule()
+
+	if deleteData {
+		return t.storage.remove()
+	}
+
+	return nil
+}
+
+// Pause stops the torrent until Resume is called. Progress is kept.
+func (s *Session) Pause(infoHash InfoHash) error {
+	t, err := s.Get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	t.stop(StatePaused)
+	s.schedule()
+
+	return nil
+}
+
+// Resume puts a paused or failed torrent back in the queue.
+func (s *Session) Resume(infoHash InfoHash) error {
+	t, err := s.Get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	if state := t.State(); state == StatePaused || state == StateError {
+		t.setState(StateQueued)
+	}
+
+	s.schedule()
+
+	return nil
+}
+
+// SetPriority changes the queue priority of the torrent. Higher priorities
+// are started first.
+func (s *Session) SetPriority(infoHash InfoHash, priority int) error {
+	t, err := s.Get(infoHash)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.priority = priority
+	t.mu.Unlock()
+
+	s.schedule()
+
+	return nil
+}
+
+// SetDownloadRate changes the download budget shared by all torrents, in
+// bytes per second. 0 means unlimited.
+func (s *Session) SetDownloadRate(bytesPerSec int) {
+	s.downLimit.SetRate(bytesPerSec)
+}
+
+// SetUploadRate changes the upload budget shared by all torrents, in bytes
+// per second. 0 means unlimited.
+func (s *Session) SetUploadRate(bytesPerSec int) {
+	s.upLimit.SetRate(bytesPerSec)
+}
+
+// Subscribe calls fn for every event of every torrent of the session until
+// the returned function is called. fn runs on the goroutine producing the
+// event and must not block.
+func (s *Session) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return s.events.subscribe(fn)
+}
+
+// Close stops every torrent and the peer listeners.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	torrents := s.sorted()
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	for _, t := range torrents {
+		t.stop(StatePaused)
+	}
+
+	return err
+}
+
+// schedule starts queued torrents, highest priority first, while there are
+// free download slots.
+func (s *Session) schedule() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	active := 0
+	var queued []*Torrent
+	for _, t := range s.sorted() {
+		switch t.State() {
+		case StateChecking, StateDownloading:
+			active++
+		case StateQueued:
+			queued = append(queued, t)
+		}
+	}
+
+	for _, t := range queued {
+		if s.cfg.MaxActive > 0 && active >= s.cfg.MaxActive {
+			break
+		}
+		t.start()
+		active++
+	}
+}
+
+// sorted returns the torrents ordered by priority and then by the order
+// they were added in. s.mu must be held.
+func (s *Session) sorted() []*Torrent {
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+
+	sort.Slice(torrents, func(i, j int) bool {
+		pi, pj := torrents[i].Priority(), torrents[j].Priority()
+		if pi != pj {
+			return pi > pj
+		}
+		return torrents[i].seq < torrents[j].seq
+	})
+
+	return torrents
+}
+
+func (s *Session) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.client.logger().Warn("failed to accept peer", "err", err)
+			continue
+		}
+
+		go s.handleInbound(conn)
+	}
+}
+
+// lsdHashes returns the swarms of the running torrents that may be announced
+// on the local network.
+func (s *Session) lsdHashes() []InfoHash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hashes []InfoHash
+	for hash, t := range s.swarms {
+		if !t.data.Info.Private && t.context() != nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// addLocalPeer connects to a peer of the local network that announced the
+// swarm of infoHash.
+func (s *Session) addLocalPeer(infoHash InfoHash, addr net.Addr) {
+	s.mu.Lock()
+	t, ok := s.swarms[infoHash]
+	s.mu.Unlock()
+	if !ok || t.data.Info.Private {
+		return
+	}
+
+	if ctx := t.context(); ctx != nil {
+		t.connect(ctx, infoHash, addr, nil, true)
+	}
+}
+
+// dialPeer connects to a peer over uTP, which yields to other traffic, and
+// falls back to TCP when the peer fails to answer over uTP or takes too long.
+// The first connection established wins.
+func (s *Session) dialPeer(ctx context.Context, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	dial := func(dial func(context.Context, string) (net.Conn, error)) {
+		conn, err := dial(ctx, addr)
+		results <- result{conn, err}
+	}
+
+	go dial(s.utp.DialContext)
+	headStart := time.NewTimer(utpHeadStart)
+	defer headStart.Stop()
+
+	pending, tcp := 1, false
+	var err error
+	for pending > 0 {
+		select {
+		case <-headStart.C:
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// The other attempt gives up once ctx is cancelled, but
+					// may have connected already
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			err = r.err
+		}
+
+		if !tcp {
+			tcp = true
+			pending++
+			go dial(dialTCP)
+		}
+	}
+
+	return nil, err
+}
+
+// handleInbound reads the handshake of a peer that connected to us and hands
+// the connection to the torrent it asks for.
+func (s *Session) handleInbound(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	log := s.client.logger().With("peer", conn.RemoteAddr().String())
+
+	conn, err := s.decrypt(conn)
+	if err != nil {
+		log.Debug("inbound encryption handshake failed", "err", err)
+		conn.Close()
+		return
+	}
+
+	remoteHash, peerV2, err := readHandshake(conn)
+	if err != nil {
+		log.Debug("inbound handshake failed", "err", err)
+		conn.Close()
+		return
+	}
+
+	var infoHash InfoHash
+	copy(infoHash[:], remoteHash)
+
+	s.mu.Lock()
+	t, ok := s.swarms[infoHash]
+	s.mu.Unlock()
+	if !ok {
+		log.Debug("inbound peer asked for unknown torrent", "torrent", infoHash.String())
+		conn.Close()
+		return
+	}
+
+	if err := writeHandshake(conn, infoHash[:], t.data.Info.HasV2()); err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	t.accept(infoHash, conn, peerV2)
+}
+
+// decrypt tells plaintext handshakes from encrypted ones and answers the
+// encryption handshake of the latter, as the encryption policy allows.
+func (s *Session) decrypt(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	head, err := r.Peek(20)
+	if err != nil {
+		return conn, err
+	}
+
+	policy := s.cfg.Encryption
+	if isPlaintextHandshake(head) {
+		if policy == EncryptionRequire {
+			return conn, errors.New("peer doesn't encrypt")
+		}
+		// Hand over the bytes already buffered
+		return &wrappedConn{Conn: conn, r: r, w: conn}, nil
+	}
+
+	if policy == EncryptionDisable {
+		return conn, errors.New("peer encrypts")
+	}
+
+	s.mu.Lock()
+	skeys := make([]InfoHash, 0, len(s.swarms))
+	for hash := range s.swarms {
+		skeys = append(skeys, hash)
+	}
+	s.mu.Unlock()
+
+	decrypted, err := mseReceive(conn, r, skeys, policy)
+	if err != nil {
+		return conn, err
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,236 @@
+package torrent
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of one second buckets rates are averaged over
+const rateWindow = 5
+
+// rateMeter counts transferred bytes and estimates the transfer rate over the
+// last few seconds.
+type rateMeter struct {
+	mu      sync.Mutex
+	total   int64
+	buckets [rateWindow]int64
+	// Unix second the newest bucket refers to
+	last int64
+}
+
+func (m *rateMeter) Add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.advance()
+	m.buckets[now%rateWindow] += int64(n)
+	m.total += int64(n)
+}
+
+func (m *rateMeter) Total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the average bytes per second over the window.
+func (m *rateMeter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.advance()
+	sum := int64(0)
+	for i, b := range m.buckets {
+		if int64(i) == now%rateWindow {
+			// Current second is still filling up
+			continue
+		}
+		sum += b
+	}
+
+	return float64(sum) / (rateWindow - 1)
+}
+
+// advance clears the buckets of the seconds that went by since the last
+// call and returns the current second. m.mu must be held.
+func (m *rateMeter) advance() int64 {
+	now := time.Now().Unix()
+	for s := max(m.last+1, now-rateWindow+1); s <= now; s++ {
+		m.buckets[s%rateWindow] = 0
+	}
+	if now > m.last {
+		m.last = now
+	}
+
+	return now
+}
+
+// peerStats tracks the transfer with a single peer.
+type peerStats struct {
+	addr    string
+	inbound bool
+	// Set once the handshake succeeded
+	connected atomic.Bool
+	// Whether the peer is choking us
+	choked atomic.Bool
+	// Whether the peer is interested in our pieces
+	interested atomic.Bool
+	// Whether we are choking the peer
+	choking atomic.Bool
+	// Whether we are interested in the pieces of the peer
+	amInterested atomic.Bool
+	// Unix nanoseconds of the last block received, or of the handshake
+	lastBlock atomic.Int64
+	// Set once the handshake succeeded
+	pc   atomic.Pointer[PeerConn]
+	down rateMeter
+	up   rateMeter
+	// Meters of the whole torrent
+	torrentDown *rateMeter
+	torrentUp   *rateMeter
+	// Budgets of the peer alone
+	downLimit *rateLimiter
+	upLimit   *rateLimiter
+
+	// Pieces to announce to the peer with HAVE
+	haveMu sync.Mutex
+	haves  []uint32
+	haveCh chan struct{}
+}
+
+func (p *peerStats) addDownloaded(n int) {
+	p.down.Add(n)
+	p.torrentDown.Add(n)
+}
+
+func (p *peerStats) addUploaded(n int) {
+	p.up.Add(n)
+	p.torrentUp.Add(n)
+}
+
+// overUTP reports whether the last connection to the peer runs over uTP.
+func (p *peerStats) overUTP() bool {
+	pc := p.pc.Load()
+	return pc != nil && pc.conn.RemoteAddr().Network() == "udp"
+}
+
+type PeerStats struct {
+	Addr    string
+	Inbound bool
+	// Whether the connection runs over uTP rather than TCP
+	UTP             bool
+	BytesDownloaded int64
+	BytesUploaded   int64
+	// Bytes per second
+	DownloadRate float64
+	// Bytes per second
+	UploadRate float64
+	// Whether the peer is choking us
+	Choked bool
+	// Whether the peer is interested in our pieces
+	Interested bool
+	// Whether we refuse to upload to the peer
+	Choking bool
+	// Whether the peer sends us nothing although we want its pieces
+	Snubbed bool
+}
+
+type Stats struct {
+	State           TorrentState
+	BytesDownloaded int64
+	BytesUploaded   int64
+	// Bytes per second
+	DownloadRate float64
+	// Bytes per second
+	UploadRate float64
+	// Bytes of the pieces of the files not skipped, and how many of them
+	// are not verified yet
+	BytesWanted int64
+	BytesLeft   int64
+	PiecesDone  int
+	PiecesTotal int
+	// Pieces waiting for or being verified
+	HashQueue int
+	// Estimated time until the download completes, 0 when it is complete or
+	// no data is flowing
+	ETA time.Duration
+	// Peers we exchanged handshakes with
+	ConnectedPeers int
+	// Peers we are connected to or trying to connect to
+	KnownPeers int
+	// Size of the swarm reported by the tracker, -1 when unknown
+	Seeders  int
+	Leechers int
+	Peers    []PeerStats
+	// Web seeds, with their URL as Addr
+	WebSeeds []PeerStats
+}
+
+// Stats returns a snapshot of the progress and transfer statistics of the
+// torrent.
+func (t *Torrent) Stats() Stats {
+	t.mu.Lock()
+	peers := make([]*peerStats, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	webSeeds := slices.Clone(t.webSeeds)
+	state := t.state
+	seeders, leechers := t.seeders, t.leechers
+	t.mu.Unlock()
+
+	wanted, done := t.pm.wantedProgress()
+	s := Stats{
+		State:           state,
+		BytesDownloaded: t.down.Total(),
+		BytesUploaded:   t.up.Total(),
+		DownloadRate:    t.down.Rate(),
+		UploadRate:      t.up.Rate(),
+		BytesWanted:     wanted,
+		BytesLeft:       wanted - done,
+		PiecesDone:      int(t.pm.DownloadedPieces()),
+		PiecesTotal:     int(t.pm.TotalPieces()),
+		HashQueue:       int(t.hashing.Load()),
+		KnownPeers:      len(peers),
+		Seeders:         seeders,
+		Leechers:        leechers,
+	}
+
+	if s.BytesLeft > 0 && s.DownloadRate > 0 {
+		s.ETA = time.Duration(float64(s.BytesLeft) / s.DownloadRate * float64(time.Second))
+	}
+
+	now := time.Now()
+	for _, p := range peers {
+		if !p.connected.Load() {
+			continue
+		}
+
+		s.ConnectedPeers++
+		s.Peers = append(s.Peers, PeerStats{
+			Addr:            p.addr,
+			Inbound:         p.inbound,
+			UTP:             p.overUTP(),
+			BytesDownloaded: p.down.Total(),
+			BytesUploaded:   p.up.Total(),
+			DownloadRate:    p.down.Rate(),
+			UploadRate:      p.up.Rate(),
+			Choked:          p.choked.Load(),
+			Interested:      p.interested.Load(),
+			Choking:         p.choking.Load(),
+			Snubbed:         p.snubbed(now),
+		})
+	}
+
+	for _, ws := range webSeeds {
+		s.WebSeeds = append(s.WebSeeds, PeerStats{
+			Addr:            ws.addr,
+			BytesDownloaded: ws.down.Total(),
+			DownloadRate:    ws.down.Rate(),
+		})
+	}
+
+	return s
+}
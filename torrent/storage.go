@@ -0,0 +1,343 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStorage maps pieces onto the file(s) described by a torrent's info
+// dictionary and writes them in place, so no reassembly step is needed once
+// the download completes. Pieces go through a write-back cache and files
+// are kept open, see disk.go.
+type fileStorage struct {
+	pieceLength int64
+	length      int64
+	dir         string
+	files       []storageFile
+	// Directory holding the files of a multi-file torrent, empty for single
+	// file torrents
+	root string
+	// Holds the parts of pieces falling into skipped files
+	partPath string
+	partOnce sync.Once
+	part     *partFile
+
+	mu sync.RWMutex
+	// Whether the parts of each file are saved to the partfile
+	parted []bool
+
+	cache      *diskCache
+	syncPolicy SyncPolicy
+	allocation AllocationMode
+
+	wmu sync.Mutex
+	// Pieces saved and not written yet
+	pending  map[uint32]pendingPiece
+	flushing bool
+	// Signalled once every pending piece is written
+	flushed *sync.Cond
+	// First write that failed, and a channel closed by it
+	err      error
+	failedCh chan struct{}
+
+	fdMu sync.Mutex
+	// Open files by path
+	fds map[string]*fileHandle
+}
+
+type storageFile struct {
+	path string
+	// Path of the file within the torrent, starting with the name of the
+	// torrent for multi-file torrents
+	name   []string
+	offset int64
+	length int64
+	// Padding files are zeros that are never saved
+	pad bool
+	// Position in fileStorage.files
+	index int
+}
+
+func newFileStorage(dir string, info *TorrentInfo) *fileStorage {
+	s := &fileStorage{
+		pieceLength: int64(info.PieceLength),
+		length:      int64(info.TotalLength()),
+		dir:         dir,
+		partPath:    filepath.Join(dir, "."+info.Name+".parts"),
+		cache:       defaultDiskCache,
+		pending:     make(map[uint32]pendingPiece),
+		failedCh:    make(chan struct{}),
+		fds:         make(map[string]*fileHandle),
+	}
+	s.flushed = sync.NewCond(&s.wmu)
+
+	files := info.Files
+	if !info.HasV1() {
+		if len(info.FileTree) == 1 && len(info.FileTree[0].Path) == 1 {
+			// Single file
+			s.files = []storageFile{{
+				path:   filepath.Join(dir, info.FileTree[0].Path[0]),
+				name:   info.FileTree[0].Path,
+				length: int64(info.FileTree[0].Length),
+			}}
+			return s
+		}
+		files = info.layoutV2()
+	}
+
+	if files == nil {
+		s.files = []storageFile{{
+			path:   filepath.Join(dir, info.Name),
+			name:   []string{info.Name},
+			length: int64(info.Length),
+		}}
+		return s
+	}
+
+	s.root = filepath.Join(dir, info.Name)
+	offset := int64(0)
+	for _, f := range files {
+		s.files = append(s.files, storageFile{
+			path:   filepath.Join(append([]string{dir, info.Name}, f.Path...)...),
+			name:   append([]string{info.Name}, f.Path...),
+			offset: offset,
+			length: int64(f.Length),
+			pad:    f.isPadding(),
+			index:  len(s.files),
+		})
+		offset += int64(f.Length)
+	}
+	s.length = offset
+
+	return s
+}
+
+func (s *fileStorage) ReadPiece(idx uint32, data []byte) error {
+	return s.readAt(data, int64(idx)*s.pieceLength)
+}
+
+// ReadBlock reads len(b) bytes of the piece at idx starting at begin. The
+// whole piece is read and kept in the read cache, as peers request the
+// blocks of a piece one after the other.
+func (s *fileStorage) ReadBlock(idx, begin uint32, b []byte) error {
+	if s.cache.readLimit == 0 {
+		return s.readAt(b, int64(idx)*s.pieceLength+int64(begin))
+	}
+
+	data, ok := s.cache.cached(s, idx)
+	if !ok {
+		off := int64(idx) * s.pieceLength
+		data = make([]byte, min(s.pieceLength, s.length-off))
+		if err := s.readAt(data, off); err != nil {
+			return err
+		}
+		s.cache.keep(s, idx, data)
+	}
+
+	if int(begin)+len(b) > len(data) {
+		return fmt.Errorf("block [%d, %d) is outside of piece %d", begin, int(begin)+len(b), idx)
+	}
+	copy(b, data[begin:])
+	return nil
+}
+
+func (s *fileStorage) writeAt(b []byte, off int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.each(b, off, func(f storageFile, chunk []byte, fileOff int64) error {
+		switch {
+		case f.pad:
+			return nil
+		case s.isParted(f.index):
+			return s.parts().writeAt(chunk, f.offset+fileOff)
+		default:
+			return s.writeFile(f, chunk, fileOff)
+		}
+	})
+}
+
+func (s *fileStorage) writeFile(f storageFile, b []byte, off int64) error {
+	h, err := s.open(f, true)
+	if err != nil {
+		return err
+	}
+	defer s.release(h)
+
+	_, err = h.f.WriteAt(b, off)
+	return err
+}
+
+// readAt reads the content at off, from the write cache for the pieces not
+// written yet.
+func (s *fileStorage) readAt(b []byte, off int64) error {
+	if !s.hasPending() {
+		return s.readDisk(b, off)
+	}
+
+	for len(b) > 0 {
+		idx := off / s.pieceLength
+		n := min(int64(len(b)), (idx+1)*s.pieceLength-off)
+		if !s.readPending(uint32(idx), off-idx*s.pieceLength, b[:n]) {
+			if err := s.readDisk(b[:n], off); err != nil {
+				return err
+			}
+		}
+		b = b[n:]
+		off += n
+	}
+
+	return nil
+}
+
+func (s *fileStorage) readDisk(b []byte, off int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.each(b, off, func(f storageFile, chunk []byte, fileOff int64) error {
+		if f.pad {
+			clear(chunk)
+			return nil
+		}
+		if s.isParted(f.index) {
+			return s.parts().readAt(chunk, f.offset+fileOff)
+		}
+
+		h, err := s.open(f, false)
+		if os.IsNotExist(err) && s.parts().readAt(chunk, f.offset+fileOff) == nil {
+			// Saved while the file was skipped in an earlier run
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer s.release(h)
+
+		_, err = h.f.ReadAt(chunk, fileOff)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// isParted reports whether the parts of the file at idx are saved to the
+// partfile. s.mu must be held.
+func (s *fileStorage) isParted(idx int) bool {
+	return s.parted != nil && s.parted[idx]
+}
+
+// parts returns the partfile, which is only created once written to.
+func (s *fileStorage) parts() *partFile {
+	s.partOnce.Do(func() {
+		numPieces := (s.length + s.pieceLength - 1) / s.pieceLength
+		s.part = newPartFile(s.partPath, s.pieceLength, int(numPieces))
+	})
+	return s.part
+}
+
+// setSkipped saves the parts of pieces falling into the file at idx to the
+// partfile while the file is skipped, unless the file was already created.
+// Once the file is wanted again the parts move to it.
+func (s *fileStorage) setSkipped(idx int, skipped bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.files[idx]
+	if f.pad || skipped == s.isParted(idx) {
+		return nil
+	}
+
+	if skipped {
+		if _, err := os.Stat(f.path); err == nil {
+			return nil
+		}
+		if s.parted == nil {
+			s.parted = make([]bool, len(s.files))
+		}
+		s.parted[idx] = true
+		return nil
+	}
+
+	if err := s.allocate(f); err != nil {
+		return err
+	}
+	part := s.parts()
+	buf := make([]byte, s.pieceLength)
+	for off := f.offset; off < f.offset+f.length; {
+		pieceEnd := (off/s.pieceLength + 1) * s.pieceLength
+		chunk := buf[:min(pieceEnd, f.offset+f.length)-off]
+		if part.has(int(off / s.pieceLength)) {
+			if err := part.readAt(chunk, off); err != nil {
+				return err
+			}
+			if err := s.writeFile(f, chunk, off-f.offset); err != nil {
+				return err
+			}
+		}
+		off += int64(len(chunk))
+	}
+	s.parted[idx] = false
+
+	for _, parted := range s.parted {
+		if parted {
+			return nil
+		}
+	}
+	// Every part moved to its file
+	return part.remove()
+}
+
+// remove deletes the downloaded content.
+func (s *fileStorage) remove() error {
+	s.closeFiles()
+	s.cache.forgetAll(s)
+	if err := s.parts().remove(); err != nil {
+		return err
+	}
+
+	if s.root != "" {
+		return os.RemoveAll(s.root)
+	}
+
+	err := os.Remove(s.files[0].path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// each splits b, which starts at the torrent-wide offset off, into the
+// chunks that fall into each file and calls fn for every one of them.
+func (s *fileStorage) each(b []byte, off int64, fn func(f storageFile, chunk []byte, fileOff int64) error) error {
+	if off < 0 || off+int64(len(b)) > s.length {
+		return fmt.Errorf("range [%d, %d) is outside of the torrent", off, off+int64(len(b)))
+	}
+
+	for _, f := range s.files {
+		if len(b) == 0 {
+			break
+		}
+		if off >= f.offset+f.length {
+			continue
+		}
+
+		fileOff := off - f.offset
+		n := f.length - fileOff
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+
+		if err := fn(f, b[:n], fileOff); err != nil {
+			return err
+		}
+
+		b = b[n:]
+		off += n
+	}
+
+	return nil
+}
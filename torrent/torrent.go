@@ -1,57 +1,99 @@
 package torrent
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
 	"fmt"
-	"net"
+	"io"
 	"reflect"
+	"slices"
 	"strings"
-)
-
-type TrackerResponse struct {
-	Interval int
-	Peers    []net.Addr
-}
 
-func trackerResponseFrom(source map[string]interface{}) (*TrackerResponse, error) {
-	tr := &TrackerResponse{}
+	"github.com/joaovictorsl/bencoding"
+)
 
-	interval, err := getField[int]("interval", source)
-	if err != nil {
-		return tr, err
-	}
+type TorrentData struct {
+	// The URL of the tracker. Empty for torrents only downloaded from web
+	// seeds or the DHT.
+	Announce string
+	// Tiers of tracker URLs, tried in order (BEP 12). Optional.
+	AnnounceList [][]string
+	// Free-form comment of the author. Optional.
+	Comment string
+	// Name and version of the program that created the torrent. Optional.
+	CreatedBy string
+	// Creation time of the torrent in seconds since the Unix epoch, 0 when
+	// unknown. Optional.
+	CreationDate int64
+	// URLs of HTTP servers hosting the content (BEP 19). Optional.
+	URLList []string
+	// URLs of HTTP seeds speaking the BitTornado protocol (BEP 17).
+	// Optional.
+	HTTPSeeds []string
+	// Character encoding of the strings of the info dictionary, usually
+	// UTF-8. Optional.
+	Encoding string
+	// DHT nodes to bootstrap from, used by trackerless torrents (BEP 5).
+	// Optional.
+	Nodes []DHTNode
+	// Hashes of the pieces of every file of a v2 torrent larger than a
+	// piece, concatenated and keyed by the pieces root of the file (BEP 52).
+	PieceLayers map[string]string
+	// Every other key of the .torrent file, with its decoded value. It is
+	// written back as is by Encode. Values must be strings, integers, lists
+	// or dictionaries of those.
+	Extra map[string]interface{}
+	// Information about the file(s)
+	Info *TorrentInfo
 
-	strPeers, err := getField[string]("peers", source)
-	if err != nil {
-		return tr, err
-	}
+	// The info dictionary exactly as it appears in the parsed .torrent
+	// file, nil for torrents built in memory
+	rawInfo []byte
+	// Whether url-list was a single string instead of a list
+	urlListString bool
+	// Optional keys of the parsed file holding an empty string, list or
+	// dictionary, or 0, which Encode writes back although the field is
+	// unset
+	emptyKeys map[string]bool
+}
 
-	peersBytes := []byte(strPeers)
-	peers := make([]net.Addr, 0)
+type DHTNode struct {
+	Host string
+	Port int
+}
 
-	for i := 0; i < len(peersBytes); i += 6 {
-		currPeer := peersBytes[i : i+6]
-		ip := currPeer[:4]
-		portBytes := currPeer[4:]
-		port := binary.BigEndian.Uint16(portBytes)
+// SetInfo replaces the info dictionary. Use it instead of modifying Info in
+// place when the change must be written by Encode: the info dictionary of a
+// parsed torrent is otherwise written exactly as it was read, which keeps the
+// info hash stable.
+func (td *TorrentData) SetInfo(info *TorrentInfo) {
+	td.Info = info
+	td.rawInfo = nil
+}
 
-		peers = append(peers, &net.TCPAddr{
-			IP:   ip,
-			Port: int(port),
-		})
+// InfoHash returns the hash identifying the torrent: the SHA1 hash of the
+// info dictionary, or the truncated InfoHashV2 of v2 only torrents.
+//
+// For parsed torrents it is the hash of the original bytes of the info
+// dictionary, so keys this package doesn't model are accounted for. Torrents
+// built in memory are hashed from Info.Encode.
+func (td *TorrentData) InfoHash() InfoHash {
+	if !td.Info.HasV1() {
+		return calcHashV2(td.encodedInfo()).Truncate()
 	}
 
-	tr.Interval = interval
-	tr.Peers = peers
-
-	return tr, nil
+	var infoHash InfoHash
+	copy(infoHash[:], calcHash(td.encodedInfo()))
+	return infoHash
 }
 
-type TorrentData struct {
-	// The URL of the tracker
-	Announce string
-	// Information about the file(s)
-	Info *TorrentInfo
+func (td *TorrentData) encodedInfo() []byte {
+	if td.rawInfo == nil {
+		// Validate rejects info dictionaries that can't be encoded
+		info, _ := td.Info.Encode()
+		return []byte(info)
+	}
+	return td.rawInfo
 }
 
 type TorrentInfo struct {
@@ -71,6 +113,8 @@ type TorrentInfo struct {
 	// String whose length is a multiple of 20. It is to be subdivided into
 	// strings of length 20, each of which is the SHA1 hash of the piece at
 	// the corresponding index.
+	//
+	// Pieces, Length and Files are nil for v2 only torrents.
 	Pieces []string
 	// Length of the file in bytes.
 	//
@@ -82,40 +126,94 @@ type TorrentInfo struct {
 	// If this field is != nil then the download
 	// represents multiple files.
 	Files []*TorrentFileInfo
+	// Whether peers may only be obtained from the trackers of the torrent
+	// (BEP 27).
+	Private bool
+	// Tag used by private trackers to make the info hash of cross-posted
+	// torrents unique. Optional.
+	Source string
+	// Hex encoded MD5 sum of the file of a single file torrent. Optional.
+	MD5Sum string
+	// 2 for v2 and hybrid torrents (BEP 52), 0 otherwise.
+	MetaVersion int
+	// Files of a v2 or hybrid torrent, in the order of the file tree.
+	FileTree []*TorrentFileV2
+	// Every other key of the info dictionary, with its decoded value.
+	Extra map[string]interface{}
+
+	// See TorrentData.emptyKeys
+	emptyKeys map[string]bool
+}
+
+// TotalLength returns the size in bytes of all the content described by the
+// info dictionary.
+func (ti TorrentInfo) TotalLength() int {
+	if !ti.HasV1() {
+		total := 0
+		for _, f := range ti.FileTree {
+			total += f.Length
+		}
+		return total
+	}
+
+	if ti.Files == nil {
+		return ti.Length
+	}
+
+	total := 0
+	for _, f := range ti.Files {
+		total += f.Length
+	}
+
+	return total
 }
 
-func (ti TorrentInfo) Encode() string {
-	var encoded string
-	piecesStr := strings.Join(ti.Pieces, "")
-	if ti.Length != 0 {
-		encoded = fmt.Sprintf(
-			"d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
-			ti.Length,
-			len(ti.Name),
-			ti.Name,
-			ti.PieceLength,
-			len(piecesStr),
-			piecesStr,
-		)
+// Encode returns the bencoded info dictionary. It fails when Extra holds
+// values that can't be bencoded.
+func (ti TorrentInfo) Encode() (string, error) {
+	dict := map[string]string{
+		"name":         encodeString(ti.Name),
+		"piece length": encodeInt(int64(ti.PieceLength)),
+	}
+
+	if !ti.HasV1() {
+		// v2 only
+	} else if ti.Files == nil {
+		dict["length"] = encodeInt(int64(ti.Length))
 	} else {
-		files := "l"
-		for _, f := range ti.Files {
-			files += f.Encode()
+		files := make([]string, len(ti.Files))
+		for i, f := range ti.Files {
+			var err error
+			if files[i], err = f.Encode(); err != nil {
+				return "", within(fmt.Sprintf("files[%d]", i), err)
+			}
 		}
-		files += "e"
+		dict["files"] = encodeList(files)
+	}
+	if ti.HasV1() {
+		dict["pieces"] = encodeString(strings.Join(ti.Pieces, ""))
+	}
+	if ti.HasV2() {
+		dict["meta version"] = encodeInt(int64(ti.MetaVersion))
+		dict["file tree"] = encodeFileTree(ti.FileTree)
+	}
 
-		encoded = fmt.Sprintf(
-			"d5:files%s4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
-			files,
-			len(ti.Name),
-			ti.Name,
-			ti.PieceLength,
-			len(piecesStr),
-			piecesStr,
-		)
+	if ti.Private {
+		dict["private"] = encodeInt(1)
+	} else if ti.emptyKeys["private"] {
+		dict["private"] = encodeInt(0)
+	}
+	if ti.Source != "" || ti.emptyKeys["source"] {
+		dict["source"] = encodeString(ti.Source)
+	}
+	if ti.MD5Sum != "" || ti.emptyKeys["md5sum"] {
+		dict["md5sum"] = encodeString(ti.MD5Sum)
+	}
+	if err := addExtra(dict, ti.Extra); err != nil {
+		return "", err
 	}
 
-	return encoded
+	return encodeDict(dict), nil
 }
 
 type TorrentFileInfo struct {
@@ -124,27 +222,232 @@ type TorrentFileInfo struct {
 	// A list of UTF-8 encoded strings corresponding to subdirectory names,
 	// the last of which is the actual file name.
 	Path []string
+	// Hex encoded MD5 sum of the file. Optional.
+	MD5Sum string
+	// File attributes (BEP 47): 'p' for padding, 'x' for executable, 'h'
+	// for hidden and 'l' for symlink. Optional.
+	Attr string
+	// Target of the symlink when Attr contains 'l'. Optional.
+	SymlinkPath []string
+	// SHA1 hash of the file content (BEP 47). Optional.
+	SHA1 string
+	// Every other key of the file dictionary, with its decoded value.
+	Extra map[string]interface{}
+
+	// See TorrentData.emptyKeys
+	emptyKeys map[string]bool
 }
 
-func (tfi TorrentFileInfo) Encode() string {
-	path := ""
-	for _, s := range tfi.Path {
-		path += fmt.Sprintf("%d:%s", len(s), s)
+// Encode returns the bencoded file dictionary. It fails when Extra holds
+// values that can't be bencoded.
+func (tfi TorrentFileInfo) Encode() (string, error) {
+	dict := map[string]string{
+		"length": encodeInt(int64(tfi.Length)),
+		"path":   encodeStringList(tfi.Path),
 	}
 
-	return fmt.Sprintf(
-		"d6:lengthi%de4:pathl%see",
-		tfi.Length,
-		path,
-	)
+	if tfi.MD5Sum != "" || tfi.emptyKeys["md5sum"] {
+		dict["md5sum"] = encodeString(tfi.MD5Sum)
+	}
+	if tfi.Attr != "" || tfi.emptyKeys["attr"] {
+		dict["attr"] = encodeString(tfi.Attr)
+	}
+	if tfi.SymlinkPath != nil {
+		dict["symlink path"] = encodeStringList(tfi.SymlinkPath)
+	}
+	if tfi.SHA1 != "" || tfi.emptyKeys["sha1"] {
+		dict["sha1"] = encodeString(tfi.SHA1)
+	}
+	if err := addExtra(dict, tfi.Extra); err != nil {
+		return "", err
+	}
+
+	return encodeDict(dict), nil
+}
+
+// Encode returns the bencoded .torrent file. The info dictionary of a parsed
+// torrent is written exactly as it was read, see SetInfo. Keys of a parsed
+// torrent holding empty values are kept. It fails when an Extra map holds
+// values that can't be bencoded.
+func (td TorrentData) Encode() (string, error) {
+	info := string(td.rawInfo)
+	if td.rawInfo == nil {
+		var err error
+		if info, err = td.Info.Encode(); err != nil {
+			return "", within("info", err)
+		}
+	}
+
+	dict := map[string]string{
+		"info": info,
+	}
+	has := func(key string, set bool) bool {
+		return set || td.emptyKeys[key]
+	}
+
+	if has("announce", td.Announce != "") {
+		dict["announce"] = encodeString(td.Announce)
+	}
+	if has("announce-list", len(td.AnnounceList) > 0) {
+		tiers := make([]string, len(td.AnnounceList))
+		for i, tier := range td.AnnounceList {
+			tiers[i] = encodeStringList(tier)
+		}
+		dict["announce-list"] = encodeList(tiers)
+	}
+	if has("comment", td.Comment != "") {
+		dict["comment"] = encodeString(td.Comment)
+	}
+	if has("created by", td.CreatedBy != "") {
+		dict["created by"] = encodeString(td.CreatedBy)
+	}
+	if has("creation date", td.CreationDate != 0) {
+		dict["creation date"] = encodeInt(td.CreationDate)
+	}
+	if has("url-list", len(td.URLList) > 0) {
+		if td.urlListString && len(td.URLList) <= 1 {
+			dict["url-list"] = encodeString(strings.Join(td.URLList, ""))
+		} else {
+			dict["url-list"] = encodeStringList(td.URLList)
+		}
+	}
+	if has("httpseeds", len(td.HTTPSeeds) > 0) {
+		dict["httpseeds"] = encodeStringList(td.HTTPSeeds)
+	}
+	if has("encoding", td.Encoding != "") {
+		dict["encoding"] = encodeString(td.Encoding)
+	}
+	if has("nodes", len(td.Nodes) > 0) {
+		nodes := make([]string, len(td.Nodes))
+		for i, n := range td.Nodes {
+			nodes[i] = encodeList([]string{encodeString(n.Host), encodeInt(int64(n.Port))})
+		}
+		dict["nodes"] = encodeList(nodes)
+	}
+	if has("piece layers", len(td.PieceLayers) > 0) {
+		layers := make(map[string]string, len(td.PieceLayers))
+		for root, hashes := range td.PieceLayers {
+			layers[root] = encodeString(hashes)
+		}
+		dict["piece layers"] = encodeDict(layers)
+	}
+	if err := addExtra(dict, td.Extra); err != nil {
+		return "", err
+	}
+
+	return encodeDict(dict), nil
+}
+
+// WriteTo writes the bencoded .torrent file to w.
+func (td TorrentData) WriteTo(w io.Writer) (int64, error) {
+	encoded, err := td.Encode()
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.WriteString(w, encoded)
+	return int64(n), err
+}
+
+// addExtra adds the keys of extra that dict doesn't have yet.
+func addExtra(dict map[string]string, extra map[string]interface{}) error {
+	for k, v := range extra {
+		if _, ok := dict[k]; ok {
+			continue
+		}
+		encoded, err := encodeValue(k, v)
+		if err != nil {
+			return err
+		}
+		dict[k] = encoded
+	}
+	return nil
+}
+
+// emptyKeys returns which of keys source holds with an empty string, list
+// or dictionary, or with 0.
+func emptyKeys(source map[string]interface{}, keys ...string) map[string]bool {
+	var empty map[string]bool
+	for _, k := range keys {
+		switch v := source[k].(type) {
+		case string:
+			if v != "" {
+				continue
+			}
+		case int:
+			if v != 0 {
+				continue
+			}
+		case []interface{}:
+			if len(v) != 0 {
+				continue
+			}
+		case map[string]interface{}:
+			if len(v) != 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		if empty == nil {
+			empty = make(map[string]bool)
+		}
+		empty[k] = true
+	}
+	return empty
+}
+
+// extraKeys returns the entries of source whose key is not in known.
+func extraKeys(source map[string]interface{}, known ...string) map[string]interface{} {
+	var extra map[string]interface{}
+	for k, v := range source {
+		if slices.Contains(known, k) {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]interface{})
+		}
+		extra[k] = v
+	}
+	return extra
+}
+
+// ReadTorrentData parses and validates a .torrent file. Malformed files are
+// reported with a *FieldError.
+func ReadTorrentData(r io.Reader) (*TorrentData, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := bencoding.DecodeTo[map[string]interface{}](bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, err
+	}
+
+	td, err := torrentDataFrom(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// The decoder loses the original encoding, so find the span of the info
+	// dictionary ourselves
+	td.rawInfo, err = rawDictValue(raw, "info")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := td.Validate(); err != nil {
+		return nil, err
+	}
+
+	return td, nil
 }
 
 func torrentDataFrom(source map[string]interface{}) (*TorrentData, error) {
 	td := &TorrentData{}
-	ti := &TorrentInfo{}
 
 	// Get announce
-	announce, err := getField[string]("announce", source)
+	announce, _, err := getOptionalField[string]("announce", source)
 	if err != nil {
 		return td, err
 	}
@@ -155,122 +458,373 @@ func torrentDataFrom(source map[string]interface{}) (*TorrentData, error) {
 		return td, err
 	}
 
-	// Get name
-	name, err := getField[string]("name", mapInfo)
+	ti, err := infoFrom(mapInfo)
 	if err != nil {
+		return td, within("info", err)
+	}
+
+	td.Announce = announce
+	td.Info = ti
+
+	if err := optionalFieldsFrom(td, source); err != nil {
 		return td, err
 	}
 
+	return td, nil
+}
+
+func infoFrom(source map[string]interface{}) (*TorrentInfo, error) {
+	ti := &TorrentInfo{}
+
+	// Get name
+	name, err := getField[string]("name", source)
+	if err != nil {
+		return ti, err
+	}
+
 	// Get piece length
-	pieceLength, err := getField[int]("piece length", mapInfo)
+	pieceLength, err := getField[int]("piece length", source)
 	if err != nil {
-		return td, err
+		return ti, err
+	}
+
+	ti.Name = name
+	ti.PieceLength = pieceLength
+
+	if err := optionalInfoFieldsFrom(ti, source); err != nil {
+		return ti, err
+	}
+
+	if _, ok := source["pieces"]; !ok && ti.HasV2() {
+		// v2 only
+		return ti, nil
 	}
 
 	// Get pieces
-	piecesStr, err := getField[string]("pieces", mapInfo)
+	piecesStr, err := getField[string]("pieces", source)
 	if err != nil {
-		return td, err
+		return ti, err
+	}
+	if len(piecesStr)%20 != 0 {
+		return ti, fieldError("pieces", ErrInvalidValue, "length %d is not a multiple of 20", len(piecesStr))
 	}
-	pieces := make([]string, 0)
+	pieces := make([]string, 0, len(piecesStr)/20)
 	for i := 0; i < len(piecesStr); i += 20 {
 		pieces = append(pieces, piecesStr[i:i+20])
 	}
 
 	// Get length or files
-	_, okL := mapInfo["length"]
-	_, okF := mapInfo["files"]
+	_, okL := source["length"]
+	_, okF := source["files"]
 	if okL == okF {
-		return td, fmt.Errorf("there can only be a key length or a key files, not both or neither")
+		return ti, fieldError("length", ErrInvalidValue, "there can only be a key length or a key files, not both or neither")
 	}
 
 	length := 0
 	var files []*TorrentFileInfo
 
 	if okL {
-		l, err := getField[int]("length", mapInfo)
+		l, err := getField[int]("length", source)
 		if err != nil {
-			return td, err
+			return ti, err
 		}
 
 		length = l
 	} else {
-		fs, err := filesFrom(mapInfo)
+		fs, err := filesFrom(source)
 		if err != nil {
-			return td, err
+			return ti, err
 		}
 
 		files = fs
 	}
 
-	ti.Name = name
-	ti.PieceLength = pieceLength
 	ti.Pieces = pieces
 	ti.Length = length
 	ti.Files = files
 
-	td.Announce = announce
-	td.Info = ti
-
-	return td, nil
+	return ti, nil
 }
 
-func filesFrom(source map[string]interface{}) ([]*TorrentFileInfo, error) {
-	iFiles, err := getField[[]interface{}]("files", source)
+// optionalFieldsFrom fills the fields of td that a .torrent file may omit.
+func optionalFieldsFrom(td *TorrentData, source map[string]interface{}) error {
+	if tiers, ok, err := getOptionalField[[]interface{}]("announce-list", source); err != nil {
+		return err
+	} else if ok {
+		for _, iTier := range tiers {
+			tier, err := stringList("announce-list", iTier)
+			if err != nil {
+				return err
+			}
+			td.AnnounceList = append(td.AnnounceList, tier)
+		}
+	}
+
+	comment, _, err := getOptionalField[string]("comment", source)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	td.Comment = comment
 
-	files := make([]*TorrentFileInfo, 0)
-	for _, m := range iFiles {
-		m2, ok := m.(map[string]interface{})
-		if !ok {
-			fmt.Println("Deu ruim1")
+	createdBy, _, err := getOptionalField[string]("created by", source)
+	if err != nil {
+		return err
+	}
+	td.CreatedBy = createdBy
+
+	creationDate, _, err := getOptionalField[int]("creation date", source)
+	if err != nil {
+		return err
+	}
+	td.CreationDate = int64(creationDate)
+
+	// url-list may be a single URL instead of a list
+	switch urls := source["url-list"].(type) {
+	case nil:
+	case string:
+		if urls != "" {
+			td.URLList = []string{urls}
 		}
-		tfi := &TorrentFileInfo{}
-		length, err := getField[int]("length", m2)
+		td.urlListString = true
+	default:
+		list, err := stringList("url-list", urls)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		td.URLList = list
+	}
 
-		path, err := getField[[]interface{}]("path", m2)
+	if seeds, ok := source["httpseeds"]; ok {
+		td.HTTPSeeds, err = stringList("httpseeds", seeds)
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+
+	encoding, _, err := getOptionalField[string]("encoding", source)
+	if err != nil {
+		return err
+	}
+	td.Encoding = encoding
+
+	if nodes, ok, err := getOptionalField[[]interface{}]("nodes", source); err != nil {
+		return err
+	} else if ok {
+		for _, iNode := range nodes {
+			node, ok := iNode.([]interface{})
+			if !ok || len(node) != 2 {
+				return fieldError("nodes", ErrWrongType, "nodes must contain [host, port] pairs")
+			}
+			host, okH := node[0].(string)
+			port, okP := node[1].(int)
+			if !okH || !okP {
+				return fieldError("nodes", ErrWrongType, "nodes must contain [host, port] pairs")
+			}
+			td.Nodes = append(td.Nodes, DHTNode{Host: host, Port: port})
 		}
+	}
 
-		path2 := make([]string, 0)
-		for _, v := range path {
-			vStr, ok := v.(string)
+	if layers, ok, err := getOptionalField[map[string]interface{}]("piece layers", source); err != nil {
+		return err
+	} else if ok {
+		td.PieceLayers = make(map[string]string, len(layers))
+		for root, iHashes := range layers {
+			hashes, ok := iHashes.(string)
 			if !ok {
-				fmt.Println("Deu ruim2")
+				return fieldError("piece layers", ErrWrongType, "expected a string, got %v", reflect.TypeOf(iHashes))
 			}
+			td.PieceLayers[root] = hashes
+		}
+	}
+
+	td.Extra = extraKeys(source,
+		"announce", "announce-list", "comment", "created by", "creation date",
+		"encoding", "httpseeds", "info", "nodes", "piece layers", "url-list",
+	)
+	td.emptyKeys = emptyKeys(source,
+		"announce", "announce-list", "comment", "created by", "creation date",
+		"encoding", "httpseeds", "nodes", "piece layers", "url-list",
+	)
+
+	return nil
+}
 
-			path2 = append(path2, vStr)
+// optionalInfoFieldsFrom fills the fields of the info dictionary that may be
+// omitted.
+func optionalInfoFieldsFrom(ti *TorrentInfo, source map[string]interface{}) error {
+	private, _, err := getOptionalField[int]("private", source)
+	if err != nil {
+		return err
+	}
+	ti.Private = private == 1
+
+	infoSource, _, err := getOptionalField[string]("source", source)
+	if err != nil {
+		return err
+	}
+	ti.Source = infoSource
+
+	md5sum, _, err := getOptionalField[string]("md5sum", source)
+	if err != nil {
+		return err
+	}
+	ti.MD5Sum = md5sum
+
+	metaVersion, _, err := getOptionalField[int]("meta version", source)
+	if err != nil {
+		return err
+	}
+	ti.MetaVersion = metaVersion
+
+	if ti.HasV2() {
+		tree, err := getField[map[string]interface{}]("file tree", source)
+		if err != nil {
+			return err
+		}
+		if err := fileTreeFrom(tree, nil, &ti.FileTree); err != nil {
+			return within("file tree", err)
 		}
+	}
 
-		tfi.Length = length
-		tfi.Path = path2
+	ti.Extra = extraKeys(source,
+		"file tree", "files", "length", "md5sum", "meta version", "name", "piece length",
+		"pieces", "private", "source",
+	)
+	ti.emptyKeys = emptyKeys(source, "md5sum", "private", "source")
+
+	return nil
+}
+
+// stringList converts a decoded bencoded list of strings.
+func stringList(field string, v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fieldError(field, ErrWrongType, "expected a list, got %v", reflect.TypeOf(v))
+	}
+
+	strs := make([]string, 0, len(list))
+	for i, item := range list {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fieldError(fmt.Sprintf("%s[%d]", field, i), ErrWrongType, "expected a string, got %v", reflect.TypeOf(item))
+		}
+		strs = append(strs, s)
+	}
+
+	return strs, nil
+}
+
+func filesFrom(source map[string]interface{}) ([]*TorrentFileInfo, error) {
+	iFiles, err := getField[[]interface{}]("files", source)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*TorrentFileInfo, 0, len(iFiles))
+	for i, m := range iFiles {
+		field := fmt.Sprintf("files[%d]", i)
+
+		m2, ok := m.(map[string]interface{})
+		if !ok {
+			return nil, fieldError(field, ErrWrongType, "expected a dictionary, got %v", reflect.TypeOf(m))
+		}
+
+		tfi, err := fileFrom(m2)
+		if err != nil {
+			return nil, within(field, err)
+		}
 
 		files = append(files, tfi)
 	}
 
 	if len(files) == 0 {
-		return nil, fmt.Errorf("files cannot be empty")
+		return nil, fieldError("files", ErrInvalidValue, "files cannot be empty")
 	}
 
 	return files, nil
 }
 
+func fileFrom(source map[string]interface{}) (*TorrentFileInfo, error) {
+	tfi := &TorrentFileInfo{}
+
+	length, err := getField[int]("length", source)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := getField[[]interface{}]("path", source)
+	if err != nil {
+		return nil, err
+	}
+
+	tfi.Length = length
+	tfi.Path, err = stringList("path", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := optionalFileFieldsFrom(tfi, source); err != nil {
+		return nil, err
+	}
+
+	return tfi, nil
+}
+
+// optionalFileFieldsFrom fills the fields of a file dictionary that may be
+// omitted.
+func optionalFileFieldsFrom(tfi *TorrentFileInfo, source map[string]interface{}) error {
+	md5sum, _, err := getOptionalField[string]("md5sum", source)
+	if err != nil {
+		return err
+	}
+	tfi.MD5Sum = md5sum
+
+	attr, _, err := getOptionalField[string]("attr", source)
+	if err != nil {
+		return err
+	}
+	tfi.Attr = attr
+
+	if target, ok := source["symlink path"]; ok {
+		tfi.SymlinkPath, err = stringList("symlink path", target)
+		if err != nil {
+			return err
+		}
+	}
+
+	sha1, _, err := getOptionalField[string]("sha1", source)
+	if err != nil {
+		return err
+	}
+	tfi.SHA1 = sha1
+
+	tfi.Extra = extraKeys(source, "attr", "length", "md5sum", "path", "sha1", "symlink path")
+	tfi.emptyKeys = emptyKeys(source, "attr", "md5sum", "sha1")
+
+	return nil
+}
+
+// getOptionalField is like getField but a missing field is not an error.
+func getOptionalField[T any](field string, source map[string]interface{}) (T, bool, error) {
+	var zero T
+	if _, ok := source[field]; !ok {
+		return zero, false, nil
+	}
+
+	v, err := getField[T](field, source)
+	return v, err == nil, err
+}
+
 func getField[T any](field string, source map[string]interface{}) (T, error) {
 	var zero T
 	iField, ok := source[field]
 	if !ok {
-		return zero, fmt.Errorf("missing %s", field)
+		return zero, &FieldError{Field: field, Err: ErrMissingField}
 	}
 
 	fieldValue, ok := iField.(T)
 	if !ok {
-		return zero, fmt.Errorf("%s is not a %v, it is a %v", field, reflect.TypeOf(zero), reflect.TypeOf(iField))
+		return zero, fieldError(field, ErrWrongType, "expected %v, got %v", reflect.TypeOf(zero), reflect.TypeOf(iField))
 	}
 
 	return fieldValue, nil
@@ -0,0 +1,864 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type TorrentState int
+
+const (
+	// Waiting in the session queue for a download slot.
+	StateQueued TorrentState = iota
+	// Connected to the swarm and downloading.
+	StateDownloading
+	// Stopped by the user, will not be scheduled until resumed.
+	StatePaused
+	// Every piece has been downloaded and verified.
+	StateCompleted
+	// Stopped because of an error, see Torrent.Err.
+	StateError
+	// Hashing the data already on disk to find out which pieces are
+	// missing.
+	StateChecking
+	// Every piece has been downloaded and the torrent keeps uploading to
+	// other peers.
+	StateSeeding
+)
+
+func (s TorrentState) String() string {
+	switch s {
+	case StateQueued:
+		return "queued"
+	case StateDownloading:
+		return "downloading"
+	case StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "completed"
+	case StateError:
+		return "error"
+	case StateChecking:
+		return "checking"
+	case StateSeeding:
+		return "seeding"
+	default:
+		return fmt.Sprintf("TorrentState(%d)", int(s))
+	}
+}
+
+// Torrent is the handle of a single download, either driven by a Session or
+// directly by Client.Download.
+type Torrent struct {
+	client   *Client
+	data     *TorrentData
+	infoHash InfoHash
+	// Info hashes of the swarms the torrent takes part in, see
+	// TorrentData.swarmHashes
+	swarms  []InfoHash
+	pm      *PieceManager
+	storage *fileStorage
+	log     *slog.Logger
+
+	// Port announced to trackers
+	port int
+	// Addresses announced to trackers (BEP 7), nil when unknown
+	ipv4 net.IP
+	ipv6 net.IP
+	// Connection slots shared with the other torrents of the session, nil
+	// means unlimited
+	conns chan struct{}
+	// Maximum number of peers of this torrent, 0 means unlimited
+	maxPeers int
+	// Number of peers unchoked for their rate, see runChoker
+	uploadSlots int
+	encryption  EncryptionPolicy
+	// Connects to peers, over TCP when nil
+	dial func(ctx context.Context, addr string) (net.Conn, error)
+	// Wakes the choker up early
+	rechokeCh chan struct{}
+	// Keep uploading once the download completes
+	seed bool
+	// Budgets shared with the other torrents of the session, nil when
+	// unlimited
+	sessionDown *rateLimiter
+	sessionUp   *rateLimiter
+	// Budgets of this torrent
+	downLimit *rateLimiter
+	upLimit   *rateLimiter
+	// Charge protocol overhead to the budgets, see bandwidth
+	countOverhead bool
+	events        *eventHub
+	down          rateMeter
+	up            rateMeter
+	// Called without any lock held once the torrent stops on its own
+	onStop func()
+
+	mu       sync.Mutex
+	state    TorrentState
+	priority int
+	// Budgets of every peer, in bytes per second
+	peerDownRate int
+	peerUpRate   int
+	seq          uint64
+	err          error
+	cancel       context.CancelFunc
+	stopped      chan struct{}
+	// Closed and replaced whenever the state changes
+	stateCh chan struct{}
+	// Context of the running download, nil while stopped
+	ctx   context.Context
+	peers map[string]*peerStats
+	// Web seeds of the running download
+	webSeeds []*peerStats
+	workers  sync.WaitGroup
+	// Swarm size reported by the last announce, -1 when unknown
+	seeders  int
+	leechers int
+	// Tracker id to send back, by swarm
+	trackerIDs map[InfoHash]string
+	// Announce URLs by tier, shuffled, the last tracker of a tier that
+	// answered first (BEP 12)
+	trackers [][]string
+	// Totals when the download started, announces report what was
+	// transferred since
+	upAtStart   int64
+	downAtStart int64
+	// Address of the peer unchoked optimistically
+	optimistic string
+	// Whether the data on disk was already checked
+	checked bool
+
+	// Serializes changes of the file priorities
+	filesMu sync.Mutex
+	// Priority of every file of storage, padding files included
+	filePriorities []FilePriority
+
+	// Verifies the pieces downloaded and the data already on disk
+	hashes *hashPool
+	// Pieces waiting for or being verified
+	hashing atomic.Int32
+}
+
+func newTorrent(client *Client, td *TorrentData, dir string, parentEvents *eventHub) *Torrent {
+	infoHash := td.InfoHash()
+
+	t := &Torrent{
+		client:   client,
+		data:     td,
+		infoHash: infoHash,
+		swarms:   td.swarmHashes(),
+		pm:       newPieceManager(piecesOf(td)),
+		storage:  newFileStorage(dir, td.Info),
+		log:      client.logger().With("torrent", infoHash.String(), "name", td.Info.Name),
+		port:     6881,
+		events:   newEventHub(parentEvents),
+		peers:    make(map[string]*peerStats),
+		seeders:  -1,
+		leechers: -1,
+
+		downLimit:  newRateLimiter(0),
+		upLimit:    newRateLimiter(0),
+		rechokeCh:  make(chan struct{}, 1),
+		trackerIDs: make(map[InfoHash]string),
+		trackers:   announceTiers(td),
+		hashes:     defaultHashPool,
+		stateCh:    make(chan struct{}),
+	}
+	t.filePriorities = make([]FilePriority, len(t.storage.files))
+	for i := range t.filePriorities {
+		t.filePriorities[i] = FileNormal
+	}
+	t.pm.onPiece = func(p Piece) {
+		t.events.publish(Event{Type: EventPieceCompleted, InfoHash: t.infoHash, Piece: p.Idx})
+		t.broadcastHave(p.Idx)
+	}
+
+	return t
+}
+
+func (t *Torrent) InfoHash() InfoHash {
+	return t.infoHash
+}
+
+func (t *Torrent) Name() string {
+	return t.data.Info.Name
+}
+
+// Metainfo returns the parsed contents of the .torrent file.
+func (t *Torrent) Metainfo() *TorrentData {
+	return t.data
+}
+
+func (t *Torrent) State() TorrentState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// Priority returns the queue priority of the torrent. Higher priorities are
+// started first.
+func (t *Torrent) Priority() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.priority
+}
+
+// SetDownloadRate limits how fast the torrent downloads, in bytes per
+// second. 0 means unlimited.
+func (t *Torrent) SetDownloadRate(bytesPerSec int) {
+	t.downLimit.SetRate(bytesPerSec)
+}
+
+// SetUploadRate limits how fast the torrent uploads, in bytes per second. 0
+// means unlimited.
+func (t *Torrent) SetUploadRate(bytesPerSec int) {
+	t.upLimit.SetRate(bytesPerSec)
+}
+
+// SetPeerRates limits how fast the torrent downloads from and uploads to
+// each of its peers and web seeds, in bytes per second. 0 means unlimited.
+func (t *Torrent) SetPeerRates(down, up int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.peerDownRate, t.peerUpRate = down, up
+	for _, p := range t.peers {
+		p.downLimit.SetRate(down)
+		p.upLimit.SetRate(up)
+	}
+	for _, ws := range t.webSeeds {
+		ws.downLimit.SetRate(down)
+	}
+}
+
+// Err returns the error that stopped the torrent, if any.
+func (t *Torrent) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Done is closed once every piece of the files not skipped has been
+// downloaded. Wanting skipped files again afterwards makes it return a new
+// channel. The last pieces may still be in the write cache, they are on disk
+// once the torrent reaches StateCompleted or StateSeeding, or is stopped.
+func (t *Torrent) Done() <-chan struct{} {
+	return t.pm.Done()
+}
+
+// Subscribe calls fn for every event of the torrent until the returned
+// function is called. fn runs on the goroutine producing the event and must
+// not block.
+func (t *Torrent) Subscribe(fn func(Event)) (unsubscribe func()) {
+	return t.events.subscribe(fn)
+}
+
+// setState moves the torrent to state and publishes the change.
+func (t *Torrent) setState(state TorrentState) {
+	t.mu.Lock()
+	changed := t.state != state
+	t.state = state
+	if changed {
+		close(t.stateCh)
+		t.stateCh = make(chan struct{})
+	}
+	t.mu.Unlock()
+
+	if changed {
+		t.log.Info("state changed", "state", state)
+		t.publishState(state)
+	}
+}
+
+// stateChanges returns a channel closed once the state changes.
+func (t *Torrent) stateChanges() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stateCh
+}
+
+func (t *Torrent) publishState(state TorrentState) {
+	t.events.publish(Event{Type: EventStateChanged, InfoHash: t.infoHash, State: state})
+}
+
+// start runs the download in the background.
+func (t *Torrent) start() {
+	t.mu.Lock()
+	if t.cancel != nil {
+		t.mu.Unlock()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.stopped = make(chan struct{})
+	t.state = StateChecking
+	close(t.stateCh)
+	t.stateCh = make(chan struct{})
+	t.err = nil
+	t.mu.Unlock()
+
+	t.log.Info("state changed", "state", StateChecking)
+	t.publishState(StateChecking)
+
+	go func() {
+		err := t.download(ctx)
+		cancelled := ctx.Err() != nil
+
+		t.mu.Lock()
+		t.cancel = nil
+		state := t.state
+		switch {
+		case cancelled:
+			// Stopped by stop, which sets the state itself
+		case err != nil:
+			state = StateError
+			t.err = err
+		default:
+			state = StateCompleted
+		}
+		close(t.stopped)
+		t.mu.Unlock()
+
+		if !cancelled {
+			t.setState(state)
+		}
+		cancel()
+		if !cancelled && t.onStop != nil {
+			t.onStop()
+		}
+	}()
+}
+
+// stop cancels a running download, waits for its peers to disconnect and
+// moves the torrent to state.
+func (t *Torrent) stop(state TorrentState) {
+	t.mu.Lock()
+	cancel, stopped := t.cancel, t.stopped
+	t.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+
+	if t.State() != StateCompleted {
+		t.setState(state)
+	}
+}
+
+// download checks the data already on disk, then announces to the tracker
+// and keeps connecting to the returned peers until every piece is
+// downloaded, or until ctx is cancelled when seeding.
+func (t *Torrent) download(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	started := false
+	defer func() {
+		cancel()
+		t.mu.Lock()
+		t.ctx = nil
+		// Any connect that saw a live ctx has registered its worker by now
+		t.mu.Unlock()
+		t.workers.Wait()
+
+		if started {
+			ctx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+			t.announce(ctx, eventStopped)
+			cancel()
+		}
+
+		if closeErr := t.storage.close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to save pieces: %w", closeErr)
+		}
+	}()
+
+	if err := t.recheck(ctx); err != nil {
+		return err
+	}
+	if !t.pm.complete() {
+		if err := t.prepareStorage(); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.ctx = ctx
+	t.mu.Unlock()
+
+	done := t.pm.Done()
+	select {
+	case <-done:
+		if !t.seed {
+			return nil
+		}
+		done = nil
+		t.setState(StateSeeding)
+	default:
+		t.setState(StateDownloading)
+		t.startWebSeeds(ctx)
+	}
+
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		t.runChoker(ctx)
+	}()
+
+	t.upAtStart, t.downAtStart = t.up.Total(), t.down.Total()
+	event := eventStarted
+	announced := false
+	for {
+		interval, err := t.announce(ctx, event)
+		if err != nil {
+			// Web seeds can complete the download on their own
+			if !announced && len(t.data.URLList)+len(t.data.HTTPSeeds) == 0 {
+				return err
+			}
+			t.log.Warn("announce failed", "err", err)
+		} else {
+			// Events are sent again until a tracker gets them
+			started = started || event == eventStarted
+			event = ""
+		}
+		announced = true
+
+		if interval <= 0 {
+			interval = 30 * time.Minute
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.storage.failed():
+			return fmt.Errorf("failed to save pieces: %w", t.storage.writeErr())
+		case <-done:
+			if !t.pm.complete() {
+				// Files were wanted again meanwhile
+				done = t.pm.Done()
+				continue
+			}
+			if err := t.storage.sync(); err != nil {
+				return fmt.Errorf("failed to save pieces: %w", err)
+			}
+			if !t.seed {
+				if started {
+					t.announce(ctx, eventCompleted)
+				}
+				return nil
+			}
+			done = nil
+			event = eventCompleted
+			t.setState(StateSeeding)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// announce sends event, empty for a regular announce, to the trackers of
+// every swarm of the torrent and connects to the peers returned. It returns
+// the shortest interval the trackers asked for, and an error only when every
+// announce failed.
+func (t *Torrent) announce(ctx context.Context, event string) (time.Duration, error) {
+	if len(t.trackers) == 0 {
+		return 0, nil
+	}
+
+	wanted, done := t.pm.wantedProgress()
+	left := wanted - done
+
+	interval := time.Duration(0)
+	var errs []error
+	for _, hash := range t.swarms {
+		tr, err := t.announceTo(ctx, announceRequest{
+			infoHash:   hash,
+			port:       t.port,
+			left:       left,
+			uploaded:   t.up.Total() - t.upAtStart,
+			downloaded: t.down.Total() - t.downAtStart,
+			event:      event,
+			trackerID:  t.trackerIDs[hash],
+			ipv4:       t.ipv4,
+			ipv6:       t.ipv6,
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		t.log.Debug("announced", "swarm", hash.String(), "peers", len(tr.Peers), "interval", tr.Interval)
+		if tr.WarningMessage != "" {
+			t.log.Warn("tracker warning", "swarm", hash.String(), "msg", tr.WarningMessage)
+		}
+		if tr.TrackerID != "" {
+			t.trackerIDs[hash] = tr.TrackerID
+		}
+		if hash == t.infoHash {
+			t.mu.Lock()
+			t.seeders, t.leechers = tr.Complete, tr.Incomplete
+			t.mu.Unlock()
+		}
+
+		d := time.Duration(max(tr.Interval, tr.MinInterval)) * time.Second
+		if interval <= 0 || d < interval {
+			interval = d
+		}
+		if event == eventStopped {
+			continue
+		}
+		for _, peer := range preferIPv6(tr.Peers) {
+			t.connect(ctx, hash, peer, nil, false)
+		}
+	}
+
+	if len(errs) == len(t.swarms) {
+		return 0, errors.Join(errs...)
+	}
+
+	return interval, nil
+}
+
+// announceTo sends ar to the first tracker that answers, trying the tiers
+// in order and the trackers of a tier in turn. The tracker answering moves
+// to the front of its tier (BEP 12).
+func (t *Torrent) announceTo(ctx context.Context, ar announceRequest) (*TrackerResponse, error) {
+	var errs []error
+	for _, tier := range t.trackers {
+		for i, u := range tier {
+			tr, err := t.client.discoverPeers(ctx, u, ar)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", u, err))
+				if ctx.Err() != nil {
+					return nil, errors.Join(errs...)
+				}
+				continue
+			}
+
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = u
+			return tr, nil
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// announceTiers returns the tiers of trackers of td, each shuffled, or the
+// announce URL alone when there is no announce list.
+func announceTiers(td *TorrentData) [][]string {
+	var tiers [][]string
+	for _, tier := range td.AnnounceList {
+		if len(tier) == 0 {
+			continue
+		}
+		tier = slices.Clone(tier)
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		tiers = append(tiers, tier)
+	}
+	if len(tiers) == 0 && td.Announce != "" {
+		tiers = [][]string{{td.Announce}}
+	}
+
+	return tiers
+}
+
+// startWebSeeds downloads from every web seed of the torrent until the
+// download completes or ctx is cancelled.
+func (t *Torrent) startWebSeeds(ctx context.Context) {
+	var seeds []*webSeed
+	add := func(u string, httpSeed bool) {
+		seeds = append(seeds, &webSeed{
+			url:      u,
+			client:   t.client,
+			httpSeed: httpSeed,
+			infoHash: t.infoHash,
+			pieceLen: t.data.Info.PieceLength,
+			pm:       t.pm,
+			storage:  t.storage,
+			stats:    t.newPeerStats(u, false),
+			log:      t.log.With("web_seed", u),
+		})
+	}
+	for _, u := range t.data.URLList {
+		add(u, false)
+	}
+	for _, u := range t.data.HTTPSeeds {
+		add(u, true)
+	}
+
+	t.mu.Lock()
+	t.webSeeds = t.webSeeds[:0]
+	for _, ws := range seeds {
+		ws.stats.downLimit.SetRate(t.peerDownRate)
+		ws.down = t.bandwidthOf(ws.stats).down
+		t.webSeeds = append(t.webSeeds, ws.stats)
+	}
+	t.mu.Unlock()
+
+	for _, ws := range seeds {
+		t.workers.Add(1)
+		go func() {
+			defer t.workers.Done()
+			ws.run(ctx)
+		}()
+	}
+}
+
+// recheck hashes the data already on disk once per torrent and marks the
+// pieces that match as downloaded.
+func (t *Torrent) recheck(ctx context.Context) error {
+	t.mu.Lock()
+	checked := t.checked
+	t.checked = true
+	t.mu.Unlock()
+
+	if checked {
+		return nil
+	}
+
+	// Pieces are read one after the other and hashed in parallel
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, p := range t.pm.pieces {
+		if err := ctx.Err(); err != nil {
+			// Check again next time
+			t.mu.Lock()
+			t.checked = false
+			t.mu.Unlock()
+			return err
+		}
+
+		buf := t.pm.buffer()
+		if err := t.storage.ReadPiece(p.Idx, buf[:p.Length]); err != nil {
+			t.pm.putBuffer(buf)
+			continue
+		}
+
+		wg.Add(1)
+		t.hashing.Add(1)
+		t.hashes.submit(p, buf[:p.Length], func(ok bool) {
+			defer wg.Done()
+			defer t.hashing.Add(-1)
+			defer t.pm.putBuffer(buf)
+			if ok {
+				t.pm.Notify(p)
+			}
+		})
+	}
+	wg.Wait()
+
+	t.log.Debug("checked existing data", "pieces", t.pm.DownloadedPieces())
+
+	return nil
+}
+
+// prepareStorage checks that the files not skipped fit on disk and
+// allocates them, before anything is downloaded.
+func (t *Torrent) prepareStorage() error {
+	t.filesMu.Lock()
+	wanted := make([]bool, len(t.filePriorities))
+	for i, p := range t.filePriorities {
+		wanted[i] = p != FileSkip
+	}
+	t.filesMu.Unlock()
+
+	return t.storage.prepare(wanted)
+}
+
+// broadcastHave tells every connected peer we have the piece at idx.
+func (t *Torrent) broadcastHave(idx uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, p := range t.peers {
+		if p.pc.Load() != nil {
+			p.queueHave(idx)
+		}
+	}
+}
+
+// queueHave queues a HAVE of the piece at idx for sendHaves.
+func (p *peerStats) queueHave(idx uint32) {
+	p.haveMu.Lock()
+	p.haves = append(p.haves, idx)
+	p.haveMu.Unlock()
+
+	select {
+	case p.haveCh <- struct{}{}:
+	default:
+	}
+}
+
+// sendHaves sends the queued HAVEs to the peer until ctx is done or the
+// connection fails, so that a slow peer holds up nobody else.
+func (p *peerStats) sendHaves(ctx context.Context, pc *PeerConn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.haveCh:
+		}
+
+		p.haveMu.Lock()
+		haves := p.haves
+		p.haves = nil
+		p.haveMu.Unlock()
+
+		for _, idx := range haves {
+			if err := pc.SendHave(idx); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// context returns the context of the running download, nil while stopped.
+func (t *Torrent) context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ctx
+}
+
+// accept hands a connection a peer opened to us to the running download.
+// infoHash is the swarm the peer asked for, peerV2 whether its handshake
+// tells it speaks the v2 protocol.
+func (t *Torrent) accept(infoHash InfoHash, conn net.Conn, peerV2 bool) {
+	ctx := t.context()
+	if ctx == nil {
+		conn.Close()
+		return
+	}
+
+	in := newPeerConnFrom(conn, uint32(t.data.Info.PieceLength))
+	in.peerV2 = peerV2
+	t.connect(ctx, infoHash, conn.RemoteAddr(), in, false)
+}
+
+// connect starts a worker for the peer at addr of the swarm of infoHash. When
+// in is not nil the peer connected to us and the handshake was already
+// exchanged. Peers found through Local Service Discovery, which never are
+// for private torrents, are preferred: they are always connected to,
+// whatever the connection limits.
+func (t *Torrent) connect(ctx context.Context, infoHash InfoHash, addr net.Addr, in *PeerConn, fromLSD bool) {
+	key := addr.String()
+	local := fromLSD && !t.data.Info.Private
+
+	t.mu.Lock()
+	_, known := t.peers[key]
+	full := t.maxPeers > 0 && len(t.peers) >= t.maxPeers && !local
+	if known || full || ctx.Err() != nil {
+		t.mu.Unlock()
+		if in != nil {
+			in.Close()
+		}
+		return
+	}
+	stats := t.newPeerStats(key, in != nil)
+	stats.downLimit.SetRate(t.peerDownRate)
+	stats.upLimit.SetRate(t.peerUpRate)
+	stats.choked.Store(true)
+	stats.choking.Store(true)
+	t.peers[key] = stats
+	t.workers.Add(1)
+	t.mu.Unlock()
+
+	go func() {
+		defer t.workers.Done()
+		defer func() {
+			t.mu.Lock()
+			delete(t.peers, key)
+			t.mu.Unlock()
+
+			if !stats.choking.Load() {
+				// Give the upload slot to another peer
+				t.requestRechoke()
+			}
+			if stats.connected.Load() {
+				t.events.publish(Event{Type: EventPeerDisconnected, InfoHash: t.infoHash, Peer: key})
+			}
+		}()
+
+		if t.conns != nil && !local {
+			select {
+			case t.conns <- struct{}{}:
+				defer func() { <-t.conns }()
+			case <-ctx.Done():
+				if in != nil {
+					in.Close()
+				}
+				return
+			}
+		}
+
+		var w *DownloadWorker
+		if in != nil {
+			w = newInboundDownloadWorker(in, infoHash[:], uint32(t.data.Info.PieceLength), t.pm, t.storage)
+		} else {
+			w = NewDownloadWorker(addr, infoHash[:], uint32(t.data.Info.PieceLength), t.pm, t.storage)
+		}
+		w.pc.bw = t.bandwidthOf(stats)
+		w.pc.bw.ctx = ctx
+		w.pc.encryption = t.encryption
+		w.pc.dial = t.dial
+		w.pc.v2 = t.data.Info.HasV2()
+		w.stats = stats
+		w.log = t.log.With("peer", key)
+		w.onInterest = t.requestRechoke
+		w.verify = t.verify
+		connCtx, disconnect := context.WithCancel(ctx)
+		defer disconnect()
+		w.onConnected = func() {
+			t.workers.Add(1)
+			go func() {
+				defer t.workers.Done()
+				stats.sendHaves(connCtx, w.pc)
+			}()
+			t.events.publish(Event{Type: EventPeerConnected, InfoHash: t.infoHash, Peer: key})
+		}
+		w.Process(ctx)
+	}()
+}
+
+// verify hashes a downloaded piece on the hashing pool and saves it once it
+// matches. data is a buffer of t.pm, handed back once done with.
+func (t *Torrent) verify(p Piece, data []byte, log *slog.Logger) {
+	// The worker that downloaded the piece is registered, the download
+	// can't be waiting for the last worker yet
+	t.workers.Add(1)
+	t.hashing.Add(1)
+	t.hashes.submit(p, data, func(ok bool) {
+		defer t.workers.Done()
+		defer t.hashing.Add(-1)
+		defer t.pm.putBuffer(data)
+		savePiece(p, data, ok, t.pm, t.storage, log)
+	})
+}
+
+func (t *Torrent) newPeerStats(addr string, inbound bool) *peerStats {
+	return &peerStats{
+		addr:        addr,
+		inbound:     inbound,
+		torrentDown: &t.down,
+		torrentUp:   &t.up,
+		downLimit:   newRateLimiter(0),
+		upLimit:     newRateLimiter(0),
+		haveCh:      make(chan struct{}, 1),
+	}
+}
+
+// bandwidthOf returns the budgets the transfer with a peer draws from: those
+// of the session, of the torrent and of the peer itself.
+func (t *Torrent) bandwidthOf(p *peerStats) bandwidth {
+	return bandwidth{
+		down:     []*rateLimiter{t.sessionDown, t.downLimit, p.downLimit},
+		up:       []*rateLimiter{t.sessionUp, t.upLimit, p.upLimit},
+		overhead: t.countOverhead,
+	}
+}
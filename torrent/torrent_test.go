@@ -0,0 +1,59 @@
+package torrent
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testInfo = "d6:lengthi5e4:name8:file.bin12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+
+func TestEncodeKeepsEmptyKeys(t *testing.T) {
+	raw := "d8:announce0:13:announce-listle7:comment0:13:creation datei0e" +
+		"4:info" + testInfo + "8:url-list0:e"
+
+	td, err := ReadTorrentData(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := td.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != raw {
+		t.Errorf("encoded = %q, want %q", encoded, raw)
+	}
+
+	// Fields set empty by the caller are left out
+	built := &TorrentData{Info: td.Info, URLList: []string{}}
+	encoded, err = built.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "d4:info" + testInfo + "e"; encoded != want {
+		t.Errorf("encoded = %q, want %q", encoded, want)
+	}
+}
+
+func TestEncodeUnsupportedExtra(t *testing.T) {
+	td, err := ReadTorrentData(strings.NewReader("d4:info" + testInfo + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td.Extra = map[string]interface{}{"x": []interface{}{1, 2.5}}
+	if _, err := td.Encode(); !errors.Is(err, ErrWrongType) || !strings.HasPrefix(err.Error(), "x[1]:") {
+		t.Errorf("Encode error = %v, want a wrong type error for x[1]", err)
+	}
+	if _, err := td.WriteTo(&strings.Builder{}); err == nil {
+		t.Error("WriteTo succeeded")
+	}
+
+	info := *td.Info
+	info.Extra = map[string]interface{}{"y": true}
+	td.SetInfo(&info)
+	td.Extra = nil
+	if err := td.Validate(); !errors.Is(err, ErrWrongType) || !strings.HasPrefix(err.Error(), "info.y:") {
+		t.Errorf("Validate error = %v, want a wrong type error for info.y", err)
+	}
+}
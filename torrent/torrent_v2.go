@@ -0,0 +1,221 @@
+package torrent
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type TorrentFileV2 struct {
+	// Subdirectory names followed by the file name, relative to the
+	// directory named after the torrent.
+	Path []string
+	// Length of the file in bytes.
+	Length int
+	// Root of the SHA-256 merkle tree over the 16 KiB blocks of the file.
+	// Empty for empty files.
+	PiecesRoot string
+}
+
+// HasV1 reports whether the torrent can be downloaded from the v1 swarm.
+func (ti TorrentInfo) HasV1() bool {
+	return ti.MetaVersion != 2 || ti.Pieces != nil
+}
+
+// HasV2 reports whether the torrent can be downloaded from the v2 swarm
+// (BEP 52). Hybrid torrents are part of both swarms.
+func (ti TorrentInfo) HasV2() bool {
+	return ti.MetaVersion == 2
+}
+
+// InfoHashV2 returns the SHA-256 hash of the info dictionary, ok is false for
+// torrents without v2 metadata.
+func (td *TorrentData) InfoHashV2() (hash InfoHashV2, ok bool) {
+	if !td.Info.HasV2() {
+		return hash, false
+	}
+
+	return calcHashV2(td.encodedInfo()), true
+}
+
+// swarmHashes returns the info hashes used in handshakes and announces: the
+// v1 hash and the truncated v2 hash for hybrid torrents, a single one
+// otherwise. The first one is InfoHash.
+func (td *TorrentData) swarmHashes() []InfoHash {
+	hashes := []InfoHash{td.InfoHash()}
+	if v2, ok := td.InfoHashV2(); ok && td.Info.HasV1() {
+		hashes = append(hashes, v2.Truncate())
+	}
+	return hashes
+}
+
+// isPadding reports whether the file only aligns the next one to a piece
+// boundary (BEP 47). Padding files are made of zeros and never saved.
+func (tfi TorrentFileInfo) isPadding() bool {
+	return strings.Contains(tfi.Attr, "p")
+}
+
+// layoutV2 returns the files of a v2 only torrent as v1 would lay them out,
+// with padding files aligning every file to a piece boundary.
+func (ti TorrentInfo) layoutV2() []*TorrentFileInfo {
+	var files []*TorrentFileInfo
+	offset := 0
+	for _, f := range ti.FileTree {
+		if rest := offset % ti.PieceLength; rest != 0 && f.Length > 0 {
+			pad := ti.PieceLength - rest
+			files = append(files, &TorrentFileInfo{
+				Length: pad,
+				Path:   []string{".pad", fmt.Sprint(pad)},
+				Attr:   "p",
+			})
+			offset += pad
+		}
+		files = append(files, &TorrentFileInfo{Length: f.Length, Path: f.Path})
+		offset += f.Length
+	}
+	return files
+}
+
+// piecesOf returns the pieces of the torrent with the hashes of every swarm
+// it is part of.
+func piecesOf(td *TorrentData) []Piece {
+	ti := td.Info
+	var pieces []Piece
+
+	if ti.HasV1() {
+		total := ti.TotalLength()
+		pieces = make([]Piece, len(ti.Pieces))
+		for i, hash := range ti.Pieces {
+			pieces[i] = Piece{
+				Idx:    uint32(i),
+				Hash:   []byte(hash),
+				Length: uint32(min(ti.PieceLength, total-i*ti.PieceLength)),
+			}
+		}
+	}
+	if !ti.HasV2() {
+		return pieces
+	}
+
+	// v2 pieces never span files, each file starts on a new piece
+	idx := 0
+	for _, f := range ti.FileTree {
+		if f.Length == 0 {
+			continue
+		}
+
+		// Files of a single piece only have their root
+		layer := f.PiecesRoot
+		leaves := ti.PieceLength / merkleBlockLen
+		if f.Length <= ti.PieceLength {
+			leaves = nextPow2((f.Length + merkleBlockLen - 1) / merkleBlockLen)
+		} else {
+			layer = td.PieceLayers[f.PiecesRoot]
+		}
+
+		for off := 0; off < f.Length; off += ti.PieceLength {
+			length := min(ti.PieceLength, f.Length-off)
+			if !ti.HasV1() {
+				pieces = append(pieces, Piece{Idx: uint32(idx), Length: uint32(length)})
+			}
+			if idx < len(pieces) {
+				pieces[idx].rootV2 = []byte(layer[off/ti.PieceLength*32:][:32])
+				pieces[idx].lengthV2 = uint32(length)
+				pieces[idx].leavesV2 = leaves
+				pieces[idx].fileRootV2 = []byte(f.PiecesRoot)
+				pieces[idx].firstLeafV2 = uint32(off / merkleBlockLen)
+			}
+			idx++
+		}
+	}
+
+	return pieces
+}
+
+func encodeFileTree(files []*TorrentFileV2) string {
+	type node struct {
+		children map[string]*node
+		file     *TorrentFileV2
+	}
+
+	root := &node{children: make(map[string]*node)}
+	for _, f := range files {
+		n := root
+		for _, name := range f.Path {
+			child, ok := n.children[name]
+			if !ok {
+				child = &node{children: make(map[string]*node)}
+				n.children[name] = child
+			}
+			n = child
+		}
+		n.file = f
+	}
+
+	var encode func(n *node) string
+	encode = func(n *node) string {
+		if n.file != nil {
+			leaf := map[string]string{"length": encodeInt(int64(n.file.Length))}
+			if n.file.PiecesRoot != "" {
+				leaf["pieces root"] = encodeString(n.file.PiecesRoot)
+			}
+			return encodeDict(map[string]string{"": encodeDict(leaf)})
+		}
+
+		dict := make(map[string]string, len(n.children))
+		for name, child := range n.children {
+			dict[name] = encode(child)
+		}
+		return encodeDict(dict)
+	}
+
+	return encode(root)
+}
+
+// fileTreeFrom appends the files under tree, found at path, to files in the
+// order of their keys.
+func fileTreeFrom(tree map[string]interface{}, path []string, files *[]*TorrentFileV2) error {
+	if iLeaf, ok := tree[""]; ok {
+		leaf, ok := iLeaf.(map[string]interface{})
+		if !ok || len(path) == 0 {
+			return fieldError(strings.Join(path, "."), ErrWrongType, "expected a file, got %v", reflect.TypeOf(iLeaf))
+		}
+
+		f := &TorrentFileV2{Path: path}
+		length, err := getField[int]("length", leaf)
+		if err != nil {
+			return within(strings.Join(path, "."), err)
+		}
+		f.Length = length
+
+		root, _, err := getOptionalField[string]("pieces root", leaf)
+		if err != nil {
+			return within(strings.Join(path, "."), err)
+		}
+		f.PiecesRoot = root
+
+		*files = append(*files, f)
+		return nil
+	}
+
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := append(path[:len(path):len(path)], name)
+
+		child, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return fieldError(strings.Join(childPath, "."), ErrWrongType, "expected a dictionary, got %v", reflect.TypeOf(tree[name]))
+		}
+		if err := fileTreeFrom(child, childPath, files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,297 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/joaovictorsl/bencoding"
+)
+
+// TrackerError is the failure reason a tracker gave for rejecting a request.
+type TrackerError struct {
+	Reason string
+}
+
+func (e *TrackerError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+type TrackerResponse struct {
+	// Seconds to wait before the next announce
+	Interval int
+	// Seconds the tracker wants at least between announces, 0 when unset
+	MinInterval int
+	// Must be sent back in the next announces when not empty
+	TrackerID string
+	// Human readable warning, the response is valid nonetheless
+	WarningMessage string
+	// Number of seeders and leechers, -1 when the tracker didn't say
+	Complete   int
+	Incomplete int
+	// IPv4 and IPv6 peers
+	Peers []net.Addr
+}
+
+// Events of the announces telling the tracker about the download, regular
+// announces have none.
+const (
+	eventStarted   = "started"
+	eventCompleted = "completed"
+	eventStopped   = "stopped"
+)
+
+// announceRequest holds the parameters of an announce that change between
+// torrents and announces.
+type announceRequest struct {
+	infoHash InfoHash
+	port     int
+	left     int64
+	// Bytes transferred since the started event
+	uploaded   int64
+	downloaded int64
+	// One of the event constants, empty for regular announces
+	event string
+	// Tracker id returned by the previous announce
+	trackerID string
+	// Our addresses to advertise (BEP 7), nil when unknown
+	ipv4 net.IP
+	ipv6 net.IP
+}
+
+func (c *Client) discoverPeers(ctx context.Context, announce string, ar announceRequest) (*TrackerResponse, error) {
+	params := url.Values{}
+	params.Add("info_hash", string(ar.infoHash[:]))
+	params.Add("peer_id", "00112233445566778899")
+	params.Add("port", strconv.Itoa(ar.port))
+	params.Add("uploaded", strconv.FormatInt(ar.uploaded, 10))
+	params.Add("downloaded", strconv.FormatInt(ar.downloaded, 10))
+	params.Add("left", strconv.FormatInt(ar.left, 10))
+	if ar.event != "" {
+		params.Add("event", ar.event)
+	}
+	params.Add("compact", "1")
+	params.Add("key", c.announceKey())
+	if ar.trackerID != "" {
+		params.Add("trackerid", ar.trackerID)
+	}
+	if ar.ipv4 != nil {
+		params.Add("ipv4", ar.ipv4.String())
+	}
+	if ar.ipv6 != nil {
+		params.Add("ipv6", ar.ipv6.String())
+	}
+
+	sep := "?"
+	if strings.Contains(announce, "?") {
+		sep = "&"
+	}
+
+	res, err := c.getTracker(ctx, announce+sep+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := bencoding.DecodeTo[map[string]interface{}](bufio.NewReader(res.Body))
+	if err != nil {
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("announce: %s", res.Status)
+		}
+		return nil, err
+	}
+
+	return trackerResponseFrom(data)
+}
+
+func trackerResponseFrom(source map[string]interface{}) (*TrackerResponse, error) {
+	tr := &TrackerResponse{Complete: -1, Incomplete: -1}
+
+	reason, ok, err := getOptionalField[string]("failure reason", source)
+	if err != nil {
+		return tr, err
+	} else if ok {
+		return tr, &TrackerError{Reason: reason}
+	}
+
+	interval, err := getField[int]("interval", source)
+	if err != nil {
+		return tr, err
+	}
+	tr.Interval = interval
+
+	if tr.MinInterval, _, err = getOptionalField[int]("min interval", source); err != nil {
+		return tr, err
+	}
+	if tr.TrackerID, _, err = getOptionalField[string]("tracker id", source); err != nil {
+		return tr, err
+	}
+	if tr.WarningMessage, _, err = getOptionalField[string]("warning message", source); err != nil {
+		return tr, err
+	}
+	if n, ok, err := getOptionalField[int]("complete", source); err != nil {
+		return tr, err
+	} else if ok {
+		tr.Complete = n
+	}
+	if n, ok, err := getOptionalField[int]("incomplete", source); err != nil {
+		return tr, err
+	} else if ok {
+		tr.Incomplete = n
+	}
+
+	switch peers := source["peers"].(type) {
+	case nil:
+		// Only peers6
+	case string:
+		tr.Peers, err = compactPeers("peers", peers, net.IPv4len)
+	case []interface{}:
+		tr.Peers, err = dictPeers(peers)
+	default:
+		err = fieldError("peers", ErrWrongType, "expected a string or a list, got %v", reflect.TypeOf(peers))
+	}
+	if err != nil {
+		return tr, err
+	}
+
+	if peers6, ok, err := getOptionalField[string]("peers6", source); err != nil {
+		return tr, err
+	} else if ok {
+		addrs, err := compactPeers("peers6", peers6, net.IPv6len)
+		if err != nil {
+			return tr, err
+		}
+		tr.Peers = append(tr.Peers, addrs...)
+	}
+
+	return tr, nil
+}
+
+// compactPeers decodes a string of peers made of ipLen bytes of IP address
+// followed by a big-endian port each.
+func compactPeers(field, peers string, ipLen int) ([]net.Addr, error) {
+	size := ipLen + 2
+	if len(peers)%size != 0 {
+		return nil, fieldError(field, ErrInvalidValue, "length %d is not a multiple of %d", len(peers), size)
+	}
+
+	addrs := make([]net.Addr, 0, len(peers)/size)
+	for i := 0; i < len(peers); i += size {
+		peer := []byte(peers[i : i+size])
+		addrs = append(addrs, &net.TCPAddr{
+			IP:   net.IP(peer[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(peer[ipLen:])),
+		})
+	}
+
+	return addrs, nil
+}
+
+// dictPeers decodes the non-compact list of peer dictionaries. Peers whose
+// address can't be resolved are left out.
+func dictPeers(peers []interface{}) ([]net.Addr, error) {
+	addrs := make([]net.Addr, 0, len(peers))
+	for i, iPeer := range peers {
+		field := fmt.Sprintf("peers[%d]", i)
+
+		peer, ok := iPeer.(map[string]interface{})
+		if !ok {
+			return nil, fieldError(field, ErrWrongType, "expected a dictionary, got %v", reflect.TypeOf(iPeer))
+		}
+
+		host, err := getField[string]("ip", peer)
+		if err != nil {
+			return nil, within(field, err)
+		}
+		port, err := getField[int]("port", peer)
+		if err != nil {
+			return nil, within(field, err)
+		}
+		if port <= 0 || port > 65535 {
+			return nil, fieldError(field+".port", ErrInvalidValue, "%d is out of range", port)
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+			continue
+		}
+
+		// A DNS name
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// preferIPv6 orders addrs alternating between IPv6 and IPv4 addresses,
+// starting with IPv6, so that connections favour IPv6 without starving IPv4
+// when connection slots are scarce. It only orders the attempts: trackers
+// don't tell which addresses belong to the same peer, so there is no
+// Happy Eyeballs race between the addresses of a peer.
+func preferIPv6(addrs []net.Addr) []net.Addr {
+	var v4, v6 []net.Addr
+	for _, a := range addrs {
+		if tcp, ok := a.(*net.TCPAddr); ok && tcp.IP.To4() == nil {
+			v6 = append(v6, a)
+		} else {
+			v4 = append(v4, a)
+		}
+	}
+
+	ordered := make([]net.Addr, 0, len(addrs))
+	for len(v4) > 0 || len(v6) > 0 {
+		if len(v6) > 0 {
+			ordered = append(ordered, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			ordered = append(ordered, v4[0])
+			v4 = v4[1:]
+		}
+	}
+
+	return ordered
+}
+
+// announceAddrs returns the addresses to advertise to trackers for a
+// listener bound to ip: ip itself, or when it is unspecified, the first
+// suitable address of each family found on the network interfaces. Private
+// IPv4 addresses are left out as they are most likely behind a NAT.
+func announceAddrs(ip net.IP) (v4, v6 net.IP) {
+	candidates := []net.IP{ip}
+	if ip == nil || ip.IsUnspecified() {
+		candidates = nil
+		ifAddrs, _ := net.InterfaceAddrs()
+		for _, a := range ifAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				candidates = append(candidates, ipNet.IP)
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		if !c.IsGlobalUnicast() {
+			continue
+		}
+		if c4 := c.To4(); c4 != nil {
+			if v4 == nil && !c4.IsPrivate() {
+				v4 = c4
+			}
+		} else if v6 == nil {
+			v6 = c
+		}
+	}
+
+	return v4, v6
+}
@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// testTracker answers announces without peers and records their queries.
+type testTracker struct {
+	*httptest.Server
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+func newTestTracker(t *testing.T) *testTracker {
+	tt := &testTracker{}
+	tt.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tt.mu.Lock()
+		tt.queries = append(tt.queries, r.URL.Query())
+		tt.mu.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	t.Cleanup(tt.Close)
+	return tt
+}
+
+func (tt *testTracker) announces() []url.Values {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return slices.Clone(tt.queries)
+}
+
+func TestAnnounceTiers(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(dead.Close)
+	live := newTestTracker(t)
+	backup := newTestTracker(t)
+
+	src := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(src, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	td, err := CreateTorrent(src, CreateOptions{
+		Trackers: [][]string{{dead.URL, live.URL}, {backup.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor := newTorrent(&Client{}, td, t.TempDir(), nil)
+	ctx := context.Background()
+
+	if _, err := tor.announce(ctx, eventStarted); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tor.trackers[0], []string{live.URL, dead.URL}) {
+		t.Errorf("first tier = %v, want the live tracker first", tor.trackers[0])
+	}
+	if len(backup.announces()) != 0 {
+		t.Error("second tier announced to while the first answers")
+	}
+
+	tor.up.Add(1000)
+	if _, err := tor.announce(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := live.announces()
+	if len(queries) != 2 {
+		t.Fatalf("%d announces to the live tracker, want 2", len(queries))
+	}
+	if q := queries[0]; q.Get("event") != eventStarted || q.Get("uploaded") != "0" || q.Get("left") != "7" {
+		t.Errorf("first announce = %v", q)
+	}
+	if q := queries[1]; q.Has("event") || q.Get("uploaded") != "1000" {
+		t.Errorf("second announce = %v", q)
+	}
+
+	live.Close()
+	if _, err := tor.announce(ctx, eventStopped); err != nil {
+		t.Fatal(err)
+	}
+	if queries := backup.announces(); len(queries) != 1 || queries[0].Get("event") != eventStopped {
+		t.Errorf("announces to the second tier = %v", queries)
+	}
+}
@@ -0,0 +1,156 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect = 0
+	udpActionScrape  = 2
+	udpActionError   = 3
+
+	// Most info hashes a scrape packet can hold
+	udpScrapeBatch = 74
+	// Timeout of the first request, doubled on every retransmission
+	udpTimeout = 15 * time.Second
+	udpRetries = 3
+)
+
+// udpTracker exchanges packets with a UDP tracker.
+type udpTracker struct {
+	conn   net.Conn
+	connID uint64
+}
+
+func dialUDPTracker(ctx context.Context, host string) (*udpTracker, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &udpTracker{conn: conn}
+
+	req := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	res, err := t.roundTrip(ctx, udpActionConnect, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(res) < 8 {
+		conn.Close()
+		return nil, errors.New("udp tracker: short connect response")
+	}
+	t.connID = binary.BigEndian.Uint64(res)
+
+	return t, nil
+}
+
+// roundTrip sends a request made of prefix, action, a fresh transaction id
+// and body, retransmitting it until the matching response arrives. It
+// returns the response body following the action and transaction id.
+func (t *udpTracker) roundTrip(ctx context.Context, action uint32, prefix []byte, body ...byte) ([]byte, error) {
+	var tid [4]byte
+	rand.Read(tid[:])
+
+	req := binary.BigEndian.AppendUint32(prefix, action)
+	req = append(req, tid[:]...)
+	req = append(req, body...)
+
+	stop := context.AfterFunc(ctx, func() { t.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, 2048)
+	timeout := udpTimeout
+	for try := 0; try <= udpRetries; try++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, err := t.conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		timeout *= 2
+		t.conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := t.conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			if n < 8 || !bytes.Equal(buf[4:8], tid[:]) {
+				// Stale response of an earlier request
+				continue
+			}
+
+			res := buf[8:n]
+			switch binary.BigEndian.Uint32(buf) {
+			case action:
+				return bytes.Clone(res), nil
+			case udpActionError:
+				return nil, &TrackerError{Reason: string(res)}
+			default:
+				return nil, errors.New("udp tracker: unexpected action")
+			}
+		}
+	}
+
+	return nil, errors.New("udp tracker: no response")
+}
+
+func (t *udpTracker) Close() error {
+	return t.conn.Close()
+}
+
+func scrapeUDP(ctx context.Context, host string, hashes []InfoHash, results map[InfoHash]ScrapeResult) error {
+	t, err := dialUDPTracker(ctx, host)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	body := make([]byte, 0, len(hashes)*len(InfoHash{}))
+	for _, h := range hashes {
+		body = append(body, h[:]...)
+	}
+
+	res, err := t.roundTrip(ctx, udpActionScrape, binary.BigEndian.AppendUint64(nil, t.connID), body...)
+	if err != nil {
+		return err
+	}
+
+	for i, h := range hashes {
+		if len(res) < (i+1)*12 {
+			break
+		}
+		entry := res[i*12:]
+		results[h] = ScrapeResult{
+			Seeders:    int(binary.BigEndian.Uint32(entry[0:])),
+			Downloaded: int(binary.BigEndian.Uint32(entry[4:])),
+			Leechers:   int(binary.BigEndian.Uint32(entry[8:])),
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,38 @@
 package torrent
 
-import "crypto/sha1"
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// InfoHash identifies a torrent by the SHA1 hash of its bencoded info
+// dictionary.
+type InfoHash [20]byte
+
+func (h InfoHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// InfoHashV2 identifies a v2 torrent (BEP 52) by the SHA-256 hash of its
+// bencoded info dictionary.
+type InfoHashV2 [32]byte
+
+func (h InfoHashV2) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// Truncate returns the first 20 bytes of the hash, used wherever the
+// protocol only has room for a v1 info hash: handshakes and announces.
+func (h InfoHashV2) Truncate() InfoHash {
+	var t InfoHash
+	copy(t[:], h[:])
+	return t
+}
+
+func calcHashV2(b []byte) InfoHashV2 {
+	return sha256.Sum256(b)
+}
 
 func calcHash(b []byte) []byte {
 	h := sha1.New()
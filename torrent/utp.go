@@ -0,0 +1,890 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Packet types of uTP (BEP 29)
+const (
+	utpData  = 0
+	utpFin   = 1
+	utpState = 2
+	utpReset = 3
+	utpSyn   = 4
+)
+
+// Extension reporting the packets received out of order
+const utpExtSack = 1
+
+const (
+	utpVersion   = 1
+	utpHeaderLen = 20
+	// Largest payload of a packet, small enough to avoid IP fragmentation
+	// on most links
+	utpMaxPayload = 1200
+	// Queuing delay LEDBAT aims for
+	utpTargetDelay = 100 * time.Millisecond
+	// Growth of the congestion window per round trip when there is no
+	// queuing delay at all
+	utpMaxCwndIncrease = 3000
+	utpMinWindow       = utpMaxPayload + utpHeaderLen
+	utpMaxWindow       = 1 << 20
+	// Receive window we advertise
+	utpRecvWindow = 1 << 20
+	// Furthest ahead of the last in-order packet we buffer packets
+	utpReorderLimit = 1024
+	// Most payload bytes buffered out of order
+	utpReorderMaxBytes = utpRecvWindow
+	// Bytes of the selective ack bitmasks we send, a multiple of 4
+	utpSackLen = 8
+	// Retransmission timeouts
+	utpInitialRTO = time.Second
+	utpMinRTO     = 500 * time.Millisecond
+	utpMaxRTO     = 30 * time.Second
+	// Times a packet is sent before the connection is given up on
+	utpMaxTransmissions = 8
+	// How often retransmissions and closing connections are looked after
+	utpTick = 50 * time.Millisecond
+	// How long a closed connection may take to deliver its last packets
+	utpLinger = 30 * time.Second
+	// How long a uTP connection attempt runs alone before TCP is tried as
+	// well
+	utpHeadStart = 500 * time.Millisecond
+)
+
+var errUTPTimeout = errors.New("utp: peer stopped answering")
+
+type utpHeader struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+	// Selective ack: bit i tells whether packet ack+2+i was received
+	sack []byte
+}
+
+// parseUTP splits a datagram into a uTP header and payload, skipping the
+// extensions. ok is false when b isn't a uTP packet.
+func parseUTP(b []byte) (h utpHeader, payload []byte, ok bool) {
+	if len(b) < utpHeaderLen || b[0]&0x0f != utpVersion || b[0]>>4 > utpSyn {
+		return h, nil, false
+	}
+
+	h = utpHeader{
+		typ:           b[0] >> 4,
+		connID:        binary.BigEndian.Uint16(b[2:]),
+		timestamp:     binary.BigEndian.Uint32(b[4:]),
+		timestampDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:           binary.BigEndian.Uint32(b[12:]),
+		seq:           binary.BigEndian.Uint16(b[16:]),
+		ack:           binary.BigEndian.Uint16(b[18:]),
+	}
+
+	off := utpHeaderLen
+	for ext := b[1]; ext != 0; {
+		if off+2 > len(b) || off+2+int(b[off+1]) > len(b) {
+			return h, nil, false
+		}
+		data := b[off+2 : off+2+int(b[off+1])]
+		if ext == utpExtSack {
+			h.sack = append([]byte(nil), data...)
+		}
+		ext = b[off]
+		off += 2 + len(data)
+	}
+
+	return h, b[off:], true
+}
+
+func (h utpHeader) marshal(payload []byte) []byte {
+	b := make([]byte, utpHeaderLen, utpHeaderLen+2+len(h.sack)+len(payload))
+	b[0] = h.typ<<4 | utpVersion
+	binary.BigEndian.PutUint16(b[2:], h.connID)
+	binary.BigEndian.PutUint32(b[4:], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:], h.wnd)
+	binary.BigEndian.PutUint16(b[16:], h.seq)
+	binary.BigEndian.PutUint16(b[18:], h.ack)
+	if len(h.sack) > 0 {
+		b[1] = utpExtSack
+		b = append(b, 0, byte(len(h.sack)))
+		b = append(b, h.sack...)
+	}
+	return append(b, payload...)
+}
+
+func utpMicros(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+type utpKey struct {
+	addr string
+	// Connection id of the packets we receive
+	id uint16
+}
+
+// utpSocket multiplexes uTP connections over a single UDP socket. It
+// listens for connections like a net.Listener and dials them.
+type utpSocket struct {
+	pc     net.PacketConn
+	accept chan *utpConn
+	closed chan struct{}
+	// Receives the datagrams that aren't uTP packets, such as DHT messages
+	// sharing the socket. They are dropped when nil.
+	other func(b []byte, addr net.Addr)
+
+	mu        sync.Mutex
+	conns     map[utpKey]*utpConn
+	closeOnce sync.Once
+}
+
+func newUTPSocket(pc net.PacketConn, other func(b []byte, addr net.Addr)) *utpSocket {
+	s := &utpSocket{
+		pc:     pc,
+		other:  other,
+		accept: make(chan *utpConn, 32),
+		closed: make(chan struct{}),
+		conns:  make(map[utpKey]*utpConn),
+	}
+
+	go s.readLoop()
+	go s.tickLoop()
+
+	return s
+}
+
+func (s *utpSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *utpSocket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the socket along with every connection.
+func (s *utpSocket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[utpKey]*utpConn)
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(net.ErrClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// DialContext connects to the peer at addr.
+func (s *utpSocket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var key utpKey
+	for {
+		key = utpKey{addr: raddr.String(), id: uint16(rand.Intn(math.MaxUint16))}
+		if _, ok := s.conns[key]; !ok {
+			break
+		}
+	}
+	c := newUTPConn(s, raddr, key, key.id+1)
+	s.conns[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.seq = 1
+	c.sendNew(utpSyn, nil)
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		s.remove(key)
+		return nil, c.err
+	case <-ctx.Done():
+		s.remove(key)
+		return nil, ctx.Err()
+	}
+}
+
+func (s *utpSocket) remove(key utpKey) {
+	s.mu.Lock()
+	delete(s.conns, key)
+	s.mu.Unlock()
+}
+
+func (s *utpSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.Close()
+				return
+			}
+			continue
+		}
+
+		h, payload, ok := parseUTP(buf[:n])
+		if !ok {
+			if s.other != nil {
+				s.other(append([]byte(nil), buf[:n]...), addr)
+			}
+			continue
+		}
+
+		key := utpKey{addr: addr.String(), id: h.connID}
+		s.mu.Lock()
+		c := s.conns[key]
+		if c == nil && h.typ == utpSyn {
+			// Packets of the connection carry the id of the SYN plus one
+			key.id++
+			if c = s.conns[key]; c == nil {
+				c = s.acceptSyn(addr, key, h)
+			}
+		}
+		s.mu.Unlock()
+
+		switch {
+		case c != nil:
+			c.receive(h, payload)
+		case h.typ != utpReset:
+			reset := utpHeader{typ: utpReset, connID: h.connID, timestamp: utpMicros(time.Now()), ack: h.seq}
+			s.pc.WriteTo(reset.marshal(nil), addr)
+		}
+	}
+}
+
+// acceptSyn registers the connection a peer opens with a SYN and queues it
+// for Accept, or returns nil when too many connections wait already. s.mu
+// must be held.
+func (s *utpSocket) acceptSyn(addr net.Addr, key utpKey, h utpHeader) *utpConn {
+	c := newUTPConn(s, addr, key, h.connID)
+	c.seq = uint16(rand.Intn(math.MaxUint16))
+	// The SYN takes up a sequence number, acked by the reply
+	c.ack = h.seq
+	c.state = utpConnected
+	close(c.connected)
+
+	select {
+	case s.accept <- c:
+		s.conns[key] = c
+		return c
+	default:
+		return nil
+	}
+}
+
+func (s *utpSocket) tickLoop() {
+	ticker := time.NewTicker(utpTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*utpConn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				if c.tick(now) {
+					s.remove(c.key)
+				}
+			}
+		}
+	}
+}
+
+type utpConnState int
+
+const (
+	utpSynSent utpConnState = iota
+	utpConnected
+)
+
+type utpPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	// Received by the peer out of order
+	sacked bool
+}
+
+func (p *utpPacket) size() int {
+	return len(p.payload) + utpHeaderLen
+}
+
+// utpConn is a reliable, ordered stream over UDP whose sending rate backs
+// off as soon as it adds delay to the link (LEDBAT), leaving room for
+// interactive traffic.
+type utpConn struct {
+	sock  *utpSocket
+	raddr net.Addr
+	key   utpKey
+	// Connection id of the packets we send
+	sendID uint16
+	// Closed once connected, and once the connection failed
+	connected chan struct{}
+	done      chan struct{}
+	// Wake up blocked reads and writes
+	readable chan struct{}
+	writable chan struct{}
+
+	mu    sync.Mutex
+	state utpConnState
+	err   error
+	// Sequence number of the next packet we send
+	seq uint16
+	// Sequence number of the last packet received in order
+	ack uint16
+	// Packets sent and not acked yet, in sequence order
+	out []*utpPacket
+	// Bytes of the packets in out
+	inflight int
+	lastAck  uint16
+	dupAcks  int
+	// Congestion window in bytes
+	cwnd float64
+	// Receive window of the peer in bytes
+	peerWnd int
+	rtt     time.Duration
+	rttVar  time.Duration
+	rto     time.Duration
+	// Delay of the last packet of the peer, echoed back to it
+	replyMicro uint32
+	// Lowest one-way delays of our packets in the current and previous
+	// minute, the lowest of the two is the base delay
+	minDelays   [2]uint32
+	delayMinute time.Time
+	// Data received in order and not read yet
+	recv []byte
+	// Packets received ahead of the next one in order
+	reorder map[uint16][]byte
+	// Payload bytes in reorder
+	reorderBytes int
+	gotFin       bool
+	finSeq       uint16
+	eof          bool
+	// Set by Close, the FIN is sent once every packet is acked
+	closed   bool
+	closedAt time.Time
+	finSent  bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUTPConn(s *utpSocket, raddr net.Addr, key utpKey, sendID uint16) *utpConn {
+	return &utpConn{
+		sock:      s,
+		raddr:     raddr,
+		key:       key,
+		sendID:    sendID,
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+		readable:  make(chan struct{}, 1),
+		writable:  make(chan struct{}, 1),
+		cwnd:      2 * utpMinWindow,
+		peerWnd:   utpRecvWindow,
+		rto:       utpInitialRTO,
+		reorder:   make(map[uint16][]byte),
+	}
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		var err error
+		switch {
+		case c.closed:
+			err = net.ErrClosed
+		case len(c.recv) > 0:
+			stalled := c.window() < utpMaxPayload
+			n := copy(b, c.recv)
+			c.recv = c.recv[n:]
+			if stalled {
+				// Tell the peer it may send again
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		case c.eof:
+			err = io.EOF
+		case c.err != nil:
+			err = c.err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err := wait(c.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		if c.closed || c.err != nil {
+			err := c.err
+			if c.closed {
+				err = net.ErrClosed
+			}
+			c.mu.Unlock()
+			return written, err
+		}
+
+		n := min(len(b)-written, utpMaxPayload)
+		window := min(int(c.cwnd), c.peerWnd)
+		// A packet may always be sent when nothing is in flight, which
+		// probes a closed receive window
+		if c.inflight > 0 && c.inflight+n+utpHeaderLen > window || len(c.out) >= utpReorderLimit {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := wait(c.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		c.sendNew(utpData, b[written:written+n])
+		c.mu.Unlock()
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close sends the data still buffered and then a FIN in the background.
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.closedAt = time.Now()
+		notify(c.readable)
+		notify(c.writable)
+	}
+
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.sock.Addr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.readable)
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.writable)
+	return nil
+}
+
+// receive handles a packet of the peer.
+func (c *utpConn) receive(h utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	now := time.Now()
+	c.replyMicro = utpMicros(now) - h.timestamp
+	c.peerWnd = int(h.wnd)
+
+	if h.typ == utpReset {
+		c.fail(syscall.ECONNRESET)
+		return
+	}
+	if c.state == utpSynSent {
+		if h.typ != utpState {
+			return
+		}
+		c.state = utpConnected
+		c.ack = h.seq - 1
+		close(c.connected)
+	}
+
+	c.processAck(h, now)
+
+	switch h.typ {
+	case utpData, utpFin:
+		c.processData(h, payload)
+	case utpSyn:
+		// Reply to the SYN, again if the first reply got lost
+		c.sendState()
+	}
+}
+
+// processAck drops the packets the peer acked and adapts the congestion
+// window. c.mu must be held.
+func (c *utpConn) processAck(h utpHeader, now time.Time) {
+	acked := 0
+	var sentAt time.Time
+	retransmitted := false
+	if seqLess(h.ack, c.seq) {
+		for len(c.out) > 0 && !seqLess(h.ack, c.out[0].seq) {
+			p := c.out[0]
+			c.out = c.out[1:]
+			if !p.sacked {
+				acked += p.size()
+			}
+			sentAt = p.sentAt
+			retransmitted = retransmitted || p.transmissions > 1
+		}
+	}
+	if acked > 0 && !retransmitted {
+		// Packets acked along with a retransmitted one waited for it,
+		// their round trip time is meaningless
+		c.updateRTT(now.Sub(sentAt))
+	}
+
+	if len(h.sack) > 0 {
+		for _, p := range c.out {
+			i := int(p.seq - h.ack - 2)
+			if !p.sacked && i < len(h.sack)*8 && h.sack[i/8]&(1<<(i%8)) != 0 {
+				p.sacked = true
+				acked += p.size()
+			}
+		}
+		c.resendLost(now)
+	}
+
+	switch {
+	case acked > 0:
+		c.inflight -= acked
+		c.dupAcks = 0
+		if c.rtt > 0 {
+			// Drop the backoff of earlier timeouts
+			c.rto = max(c.rtt+4*c.rttVar, utpMinRTO)
+		}
+		c.ledbat(h.timestampDiff, acked, now)
+		notify(c.writable)
+	case h.typ == utpState && len(c.out) > 0 && h.ack == c.lastAck:
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			// The packet after the acked one is lost
+			c.cwnd = max(c.cwnd/2, utpMinWindow)
+			c.transmit(c.out[0])
+		}
+	}
+	c.lastAck = h.ack
+}
+
+// resendLost retransmits the packets followed by at least three packets the
+// peer received out of order, which must have been lost. c.mu must be held.
+func (c *utpConn) resendLost(now time.Time) {
+	after := 0
+	lost := false
+	for i := len(c.out) - 1; i >= 0; i-- {
+		p := c.out[i]
+		if p.sacked {
+			after++
+			continue
+		}
+		if after >= 3 && now.Sub(p.sentAt) > c.rtt {
+			c.transmit(p)
+			lost = true
+		}
+	}
+
+	if lost {
+		c.cwnd = max(c.cwnd/2, utpMinWindow)
+	}
+}
+
+// processData queues the payload of a DATA or FIN packet for reading, in
+// order. Packets past the receive window we advertised, or that don't fit
+// in the reorder buffer, are dropped unacked for the peer to send again.
+// c.mu must be held.
+func (c *utpConn) processData(h utpHeader, payload []byte) {
+	if h.typ == utpFin && !c.gotFin {
+		c.gotFin = true
+		c.finSeq = h.seq
+	}
+
+	switch {
+	case h.seq == c.ack+1 && len(payload) <= c.window():
+		c.ack++
+		c.recv = append(c.recv, payload...)
+		for {
+			next, ok := c.reorder[c.ack+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ack+1)
+			c.reorderBytes -= len(next)
+			c.ack++
+			c.recv = append(c.recv, next...)
+		}
+		if c.gotFin && c.ack == c.finSeq {
+			c.eof = true
+		}
+		notify(c.readable)
+	case seqLess(c.ack+1, h.seq) && h.seq-c.ack < utpReorderLimit:
+		if _, ok := c.reorder[h.seq]; ok || c.reorderBytes+len(payload) > utpReorderMaxBytes {
+			break
+		}
+		c.reorder[h.seq] = append([]byte(nil), payload...)
+		c.reorderBytes += len(payload)
+	}
+
+	c.sendState()
+}
+
+// ledbat grows the congestion window while the queuing delay stays under
+// target and shrinks it above. sample is the one-way delay the peer
+// measured for our last packet, offset by the difference of our clocks.
+// c.mu must be held.
+func (c *utpConn) ledbat(sample uint32, acked int, now time.Time) {
+	offTarget := 1.0
+	if sample != 0 {
+		switch {
+		case c.delayMinute.IsZero():
+			c.minDelays = [2]uint32{sample, sample}
+			c.delayMinute = now
+		case now.Sub(c.delayMinute) > time.Minute:
+			c.minDelays = [2]uint32{sample, c.minDelays[0]}
+			c.delayMinute = now
+		case int32(sample-c.minDelays[0]) < 0:
+			c.minDelays[0] = sample
+		}
+
+		base := c.minDelays[0]
+		if int32(c.minDelays[1]-base) < 0 {
+			base = c.minDelays[1]
+		}
+		delay := time.Duration(sample-base) * time.Microsecond
+		offTarget = float64(utpTargetDelay-delay) / float64(utpTargetDelay)
+	}
+
+	factor := float64(acked) / max(c.cwnd, float64(acked))
+	c.cwnd += utpMaxCwndIncrease * offTarget * factor
+	c.cwnd = min(max(c.cwnd, utpMinWindow), utpMaxWindow)
+}
+
+// updateRTT estimates the round trip time and the retransmission timeout
+// from a sample (RFC 6298). c.mu must be held.
+func (c *utpConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, utpMinRTO)
+}
+
+// tick retransmits the oldest packet once it timed out and sends the FIN
+// of a closed connection. It reports whether the connection is over and
+// can be forgotten.
+func (c *utpConn) tick(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return true
+	}
+
+	if len(c.out) > 0 && now.Sub(c.out[0].sentAt) > c.rto {
+		if c.out[0].transmissions >= utpMaxTransmissions {
+			c.fail(errUTPTimeout)
+			return true
+		}
+		c.rto = min(c.rto*2, utpMaxRTO)
+		c.cwnd = utpMinWindow
+		c.transmit(c.out[0])
+	}
+
+	if !c.closed {
+		return false
+	}
+	if c.state == utpSynSent || now.Sub(c.closedAt) > utpLinger {
+		c.fail(net.ErrClosed)
+		return true
+	}
+	if len(c.out) == 0 {
+		if c.finSent {
+			return true
+		}
+		c.sendNew(utpFin, nil)
+		c.finSent = true
+	}
+
+	return false
+}
+
+// sackMask returns the selective ack of the packets received out of order,
+// nil when there are none. c.mu must be held.
+func (c *utpConn) sackMask() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+
+	mask := make([]byte, utpSackLen)
+	for seq := range c.reorder {
+		if i := int(seq - c.ack - 2); i < len(mask)*8 {
+			mask[i/8] |= 1 << (i % 8)
+		}
+	}
+	return mask
+}
+
+// window returns the receive window we advertise. c.mu must be held.
+func (c *utpConn) window() int {
+	return max(utpRecvWindow-len(c.recv), 0)
+}
+
+// sendNew sends a packet taking up a sequence number, to be retransmitted
+// until acked. c.mu must be held.
+func (c *utpConn) sendNew(typ byte, payload []byte) {
+	p := &utpPacket{typ: typ, seq: c.seq, payload: append([]byte(nil), payload...)}
+	c.seq++
+	c.out = append(c.out, p)
+	c.inflight += p.size()
+	c.transmit(p)
+}
+
+func (c *utpConn) transmit(p *utpPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.send(p.typ, p.seq, p.payload)
+}
+
+// sendState acks the packets received so far. c.mu must be held.
+func (c *utpConn) sendState() {
+	c.send(utpState, c.seq, nil)
+}
+
+func (c *utpConn) send(typ byte, seq uint16, payload []byte) {
+	h := utpHeader{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     utpMicros(time.Now()),
+		timestampDiff: c.replyMicro,
+		wnd:           uint32(c.window()),
+		seq:           seq,
+		ack:           c.ack,
+	}
+	switch typ {
+	case utpSyn:
+		h.connID = c.key.id
+	case utpState:
+		h.sack = c.sackMask()
+	}
+
+	c.sock.pc.WriteTo(h.marshal(payload), c.raddr)
+}
+
+// fail ends the connection with err. c.mu must be held.
+func (c *utpConn) fail(err error) {
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	close(c.done)
+	notify(c.readable)
+	notify(c.writable)
+}
+
+// notify wakes up a goroutine waiting on ch, if any.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified or the deadline passes.
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reorderConn delays every seventh DATA packet it sends, so that the peer
+// receives it after the ones sent next.
+type reorderConn struct {
+	net.PacketConn
+	sent    atomic.Int64
+	delayed atomic.Int64
+}
+
+func (c *reorderConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if b[0]>>4 == utpData && c.sent.Add(1)%7 == 0 {
+		c.delayed.Add(1)
+		b = bytes.Clone(b)
+		time.AfterFunc(20*time.Millisecond, func() { c.PacketConn.WriteTo(b, addr) })
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newTestUTPSocket(t *testing.T, wrap func(net.PacketConn) net.PacketConn) *utpSocket {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrap != nil {
+		pc = wrap(pc)
+	}
+	s := newUTPSocket(pc, nil)
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestUTPTransfer(t *testing.T) {
+	var rc *reorderConn
+	client := newTestUTPSocket(t, func(pc net.PacketConn) net.PacketConn {
+		rc = &reorderConn{PacketConn: pc}
+		return rc
+	})
+	server := newTestUTPSocket(t, nil)
+
+	data := make([]byte, 4<<20+123)
+	rand.Read(data)
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			received <- result{err: err}
+			return
+		}
+		defer conn.Close()
+
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		b, err := io.ReadAll(conn)
+		received <- result{b, err}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.DialContext(ctx, server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// The FIN goes out once everything is acked and ends the reads with EOF
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-received
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !bytes.Equal(r.data, data) {
+		t.Fatalf("received %d bytes differing from the %d sent", len(r.data), len(data))
+	}
+	if rc.delayed.Load() == 0 {
+		t.Error("no packet was delivered out of order")
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after close: err = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestUTPReceiveLimits(t *testing.T) {
+	s := newTestUTPSocket(t, nil)
+	c := newUTPConn(s, s.Addr(), utpKey{id: 1}, 2)
+	c.state = utpConnected
+	payload := make([]byte, utpMaxPayload)
+
+	// A peer ignoring the window we advertise
+	for seq := uint16(1); seq < 2*utpRecvWindow/utpMaxPayload; seq++ {
+		c.processData(utpHeader{typ: utpData, seq: seq}, payload)
+	}
+	if len(c.recv) > utpRecvWindow {
+		t.Errorf("buffered %d bytes in order, more than the %d byte window", len(c.recv), utpRecvWindow)
+	}
+	ack := c.ack
+
+	// Packets past a hole, more than the reorder buffer takes
+	for seq := ack + 2; seq < ack+utpReorderLimit; seq++ {
+		c.processData(utpHeader{typ: utpData, seq: seq}, payload)
+	}
+	if c.reorderBytes > utpReorderMaxBytes {
+		t.Errorf("buffered %d bytes out of order, more than %d", c.reorderBytes, utpReorderMaxBytes)
+	}
+	if c.ack != ack {
+		t.Errorf("ack moved from %d to %d past a hole", ack, c.ack)
+	}
+
+	// Reading makes room for the packet filling the hole
+	c.recv = nil
+	c.processData(utpHeader{typ: utpData, seq: ack + 1}, payload)
+	if c.ack == ack {
+		t.Error("packet filling the hole dropped")
+	}
+}
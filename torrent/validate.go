@@ -0,0 +1,289 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Largest piece length accepted, every worker keeps a buffer of this size
+const maxPieceLength = 128 * 1024 * 1024
+
+var (
+	ErrMissingField = errors.New("missing field")
+	ErrWrongType    = errors.New("wrong type")
+	ErrInvalidValue = errors.New("invalid value")
+	// A file path escapes the download directory
+	ErrUnsafePath    = errors.New("unsafe path")
+	ErrDuplicatePath = errors.New("duplicate path")
+	ErrInvalidUTF8   = errors.New("invalid UTF-8")
+)
+
+// FieldError reports a missing or invalid field of a bencoded dictionary,
+// such as a .torrent file or a tracker response. Err wraps one of the Err*
+// variables above, use errors.Is to tell them apart.
+type FieldError struct {
+	// Path of the field, e.g. "info.files[2].path"
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func fieldError(field string, kind error, format string, args ...any) *FieldError {
+	return &FieldError{
+		Field: field,
+		Err:   fmt.Errorf("%w: %s", kind, fmt.Sprintf(format, args...)),
+	}
+}
+
+// within prefixes the field of a FieldError with the dictionary it was found
+// in.
+func within(parent string, err error) error {
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		return err
+	}
+
+	return &FieldError{Field: parent + "." + fe.Field, Err: fe.Err}
+}
+
+// Validate checks that the metainfo is consistent and safe to download:
+// the pieces cover exactly the content, and every file stays inside the
+// download directory.
+func (td *TorrentData) Validate() error {
+	ti := td.Info
+	if ti == nil {
+		return &FieldError{Field: "info", Err: ErrMissingField}
+	}
+	// Torrents built in memory are hashed from Info.Encode
+	if td.rawInfo == nil {
+		if _, err := ti.Encode(); err != nil {
+			return within("info", err)
+		}
+	}
+
+	if err := validName("info.name", ti.Name); err != nil {
+		return err
+	}
+
+	if ti.PieceLength <= 0 || ti.PieceLength > maxPieceLength {
+		return fieldError("info.piece length", ErrInvalidValue, "%d is out of range", ti.PieceLength)
+	}
+
+	if ti.HasV1() {
+		if err := validV1(ti); err != nil {
+			return err
+		}
+	}
+	if ti.HasV2() {
+		return td.validV2()
+	}
+
+	return nil
+}
+
+func validV1(ti *TorrentInfo) error {
+	for i, p := range ti.Pieces {
+		if len(p) != 20 {
+			return fieldError(fmt.Sprintf("info.pieces[%d]", i), ErrInvalidValue, "hash is %d bytes long", len(p))
+		}
+	}
+
+	total := int64(0)
+	if ti.Files == nil {
+		if ti.Length < 0 {
+			return fieldError("info.length", ErrInvalidValue, "%d is negative", ti.Length)
+		}
+		total = int64(ti.Length)
+	} else {
+		if len(ti.Files) == 0 {
+			return fieldError("info.files", ErrInvalidValue, "list is empty")
+		}
+		paths := make([][]string, len(ti.Files))
+		for i, f := range ti.Files {
+			paths[i] = f.Path
+		}
+		isPadding := func(i int) bool { return ti.Files[i].isPadding() }
+		if err := validPaths("info.files[%d].path", paths, isPadding); err != nil {
+			return err
+		}
+		for i, f := range ti.Files {
+			if f.Length < 0 || int64(f.Length) > math.MaxInt64-total {
+				return fieldError(fmt.Sprintf("info.files[%d].length", i), ErrInvalidValue, "%d is out of range", f.Length)
+			}
+			total += int64(f.Length)
+		}
+	}
+
+	if total == 0 {
+		return fieldError("info.length", ErrInvalidValue, "content is empty")
+	}
+
+	want := (total + int64(ti.PieceLength) - 1) / int64(ti.PieceLength)
+	if int64(len(ti.Pieces)) != want {
+		return fieldError("info.pieces", ErrInvalidValue, "%d pieces for %d bytes, want %d", len(ti.Pieces), total, want)
+	}
+
+	return nil
+}
+
+// validV2 checks the file tree and piece layers of a v2 or hybrid torrent,
+// and that both halves of a hybrid torrent describe the same content.
+func (td *TorrentData) validV2() error {
+	ti := td.Info
+	if ti.PieceLength < merkleBlockLen || ti.PieceLength&(ti.PieceLength-1) != 0 {
+		return fieldError("info.piece length", ErrInvalidValue, "%d is not a power of two of at least 16 KiB", ti.PieceLength)
+	}
+	if len(ti.FileTree) == 0 {
+		return fieldError("info.file tree", ErrInvalidValue, "tree has no files")
+	}
+
+	paths := make([][]string, len(ti.FileTree))
+	for i, f := range ti.FileTree {
+		paths[i] = f.Path
+	}
+	if err := validPaths("info.file tree[%d]", paths, nil); err != nil {
+		return err
+	}
+
+	// Hash of a piece made only of padding
+	pad := merkleRoot(nil, ti.PieceLength/merkleBlockLen)
+
+	total := int64(0)
+	pieces := 0
+	for i, f := range ti.FileTree {
+		field := fmt.Sprintf("info.file tree[%d]", i)
+		if f.Length < 0 || int64(f.Length) > math.MaxInt64-total {
+			return fieldError(field+".length", ErrInvalidValue, "%d is out of range", f.Length)
+		}
+		total += int64(f.Length)
+		if f.Length == 0 {
+			continue
+		}
+
+		if len(f.PiecesRoot) != 32 {
+			return fieldError(field+".pieces root", ErrInvalidValue, "root is %d bytes long", len(f.PiecesRoot))
+		}
+
+		n := (f.Length-1)/ti.PieceLength + 1
+		pieces += n
+		if n == 1 {
+			continue
+		}
+
+		layer := td.PieceLayers[f.PiecesRoot]
+		if len(layer) != 32*n {
+			return fieldError("piece layers", ErrInvalidValue, "%d bytes of hashes for %s, want %d", len(layer), field, 32*n)
+		}
+
+		hashes := make([][32]byte, n)
+		for j := range hashes {
+			copy(hashes[j][:], layer[32*j:])
+		}
+		if root := merkleReduce(hashes, nextPow2(n), pad); string(root[:]) != f.PiecesRoot {
+			return fieldError("piece layers", ErrInvalidValue, "hashes of %s don't match its pieces root", field)
+		}
+	}
+
+	if total == 0 {
+		return fieldError("info.file tree", ErrInvalidValue, "content is empty")
+	}
+
+	if !ti.HasV1() {
+		return nil
+	}
+
+	if pieces != len(ti.Pieces) {
+		return fieldError("info.pieces", ErrInvalidValue, "%d pieces, the file tree has %d", len(ti.Pieces), pieces)
+	}
+
+	v1 := []*TorrentFileInfo{{Path: []string{ti.Name}, Length: ti.Length}}
+	if ti.Files != nil {
+		v1 = v1[:0]
+		for _, f := range ti.Files {
+			if !f.isPadding() {
+				v1 = append(v1, f)
+			}
+		}
+	}
+	same := len(v1) == len(ti.FileTree)
+	for i := 0; same && i < len(v1); i++ {
+		same = v1[i].Length == ti.FileTree[i].Length && slices.Equal(v1[i].Path, ti.FileTree[i].Path)
+	}
+	if !same {
+		return fieldError("info.file tree", ErrInvalidValue, "files differ from the v1 files of the hybrid torrent")
+	}
+
+	return nil
+}
+
+// validPaths checks the file paths of a torrent: every component must be a
+// plain name and no two files may share a path, nor may a file be the
+// directory of another. field formats the name of the field of a path from
+// its index, and the paths for which skip returns true are ignored.
+func validPaths(field string, files [][]string, skip func(i int) bool) error {
+	paths := make(map[string]bool, len(files))
+	dirs := make(map[string]bool)
+
+	for i, path := range files {
+		if skip != nil && skip(i) {
+			continue
+		}
+		field := fmt.Sprintf(field, i)
+		if len(path) == 0 {
+			return fieldError(field, ErrInvalidValue, "path is empty")
+		}
+
+		for _, component := range path {
+			if err := validName(field, component); err != nil {
+				return err
+			}
+		}
+
+		joined := strings.Join(path, "/")
+		if paths[joined] || dirs[joined] {
+			return fieldError(field, ErrDuplicatePath, "%q", joined)
+		}
+		paths[joined] = true
+
+		for j := 1; j < len(path); j++ {
+			dir := strings.Join(path[:j], "/")
+			if paths[dir] {
+				return fieldError(field, ErrDuplicatePath, "%q is a file", dir)
+			}
+			dirs[dir] = true
+		}
+	}
+
+	return nil
+}
+
+// validName checks a single component of a path saved to disk.
+func validName(field, name string) error {
+	switch {
+	case !utf8.ValidString(name):
+		return fieldError(field, ErrInvalidUTF8, "%q", name)
+	case name == "":
+		return fieldError(field, ErrInvalidValue, "name is empty")
+	case name == "." || name == "..":
+		return fieldError(field, ErrUnsafePath, "%q", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		// Covers absolute paths as well
+		return fieldError(field, ErrUnsafePath, "%q contains a separator", name)
+	case len(name) >= 2 && name[1] == ':':
+		// Drive letter
+		return fieldError(field, ErrUnsafePath, "%q", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package torrent
+
+import "sync"
+
+// VerifyPieces hashes the content of the torrent saved under dir and
+// reports, for every piece, whether it is present and matches its hash.
+// Pieces are hashed on every CPU.
+func VerifyPieces(td *TorrentData, dir string) []bool {
+	pm := newPieceManager(piecesOf(td))
+	storage := newFileStorage(dir, td.Info)
+	defer storage.closeFiles()
+
+	valid := make([]bool, len(pm.pieces))
+	var wg sync.WaitGroup
+	for i, p := range pm.pieces {
+		buf := pm.buffer()
+		if err := storage.ReadPiece(p.Idx, buf[:p.Length]); err != nil {
+			pm.putBuffer(buf)
+			continue
+		}
+
+		wg.Add(1)
+		defaultHashPool.submit(p, buf[:p.Length], func(ok bool) {
+			defer wg.Done()
+			defer pm.putBuffer(buf)
+			valid[i] = ok
+		})
+	}
+	wg.Wait()
+
+	return valid
+}
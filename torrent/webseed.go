@@ -0,0 +1,223 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a failing web seed is left alone, doubled on every
+	// consecutive failure
+	webSeedMinBackoff = 5 * time.Second
+	webSeedMaxBackoff = 10 * time.Minute
+)
+
+// errBadSeedData is returned when a web seed serves data failing the hash
+// check. Such a seed is dropped rather than retried, its content is likely
+// not the one of the torrent.
+var errBadSeedData = errors.New("piece hash doesn't match")
+
+// errSeedBusy is returned by HTTP seeds asking us to come back later.
+type errSeedBusy struct {
+	retryAfter time.Duration
+}
+
+func (e errSeedBusy) Error() string {
+	return fmt.Sprintf("seed is busy, retry in %s", e.retryAfter)
+}
+
+// webSeed downloads pieces over HTTP, either from a server hosting the
+// content (BEP 19) or from an HTTP seed speaking the BitTornado protocol
+// (BEP 17). It takes pieces from the same piece manager as the peers.
+type webSeed struct {
+	url    string
+	client *Client
+	// BEP 17 instead of BEP 19
+	httpSeed bool
+	infoHash InfoHash
+	pieceLen int
+	pm       *PieceManager
+	storage  *fileStorage
+	// Budgets the downloaded bytes are charged to
+	down  []*rateLimiter
+	stats *peerStats
+	log   *slog.Logger
+}
+
+// run downloads pieces until every piece is downloaded or ctx is cancelled,
+// backing off while the server fails. It gives up on servers sending bad
+// data.
+func (ws *webSeed) run(ctx context.Context) {
+	data := make([]byte, ws.pieceLen)
+	backoff := webSeedMinBackoff
+
+	for ctx.Err() == nil {
+		if ws.storage.cache.waitWritable(ctx) != nil {
+			return
+		}
+
+		p, ok := ws.pm.nextPiece(func(uint32) bool { return true })
+		if !ok {
+			// The pieces left are being downloaded from peers
+			select {
+			case <-ctx.Done():
+			case <-ws.pm.Done():
+				return
+			case <-time.After(idleReadTimeout):
+			}
+			continue
+		}
+
+		err := ws.downloadPiece(ctx, p, data[:p.Length])
+		if err == nil {
+			backoff = webSeedMinBackoff
+			continue
+		}
+
+		ws.pm.putBack(p)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errBadSeedData) {
+			ws.log.Warn("dropping web seed", "piece", p.Idx, "err", err)
+			return
+		}
+
+		wait := backoff
+		var busy errSeedBusy
+		if errors.As(err, &busy) {
+			wait = busy.retryAfter
+		} else {
+			backoff = min(backoff*2, webSeedMaxBackoff)
+		}
+		ws.log.Warn("web seed failed", "piece", p.Idx, "err", err, "retry_in", wait)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// downloadPiece fetches, verifies and saves p.
+func (ws *webSeed) downloadPiece(ctx context.Context, p Piece, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	var err error
+	if ws.httpSeed {
+		err = ws.fetchHTTPSeed(ctx, p.Idx, data)
+	} else {
+		off := int64(p.Idx) * int64(ws.pieceLen)
+		err = ws.storage.each(data, off, func(f storageFile, chunk []byte, fileOff int64) error {
+			if f.pad {
+				clear(chunk)
+				return nil
+			}
+			return ws.fetchRange(ctx, f.name, fileOff, chunk)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if !p.verify(data) {
+		return errBadSeedData
+	}
+
+	savePiece(p, data, true, ws.pm, ws.storage, ws.log)
+	return nil
+}
+
+// fetchRange reads len(b) bytes at off of the file at name (BEP 19).
+func (ws *webSeed) fetchRange(ctx context.Context, name []string, off int64, b []byte) error {
+	u := ws.url
+	if len(name) > 1 || strings.HasSuffix(u, "/") {
+		// The URL is a directory holding the content
+		escaped := make([]string, len(name))
+		for i, n := range name {
+			escaped[i] = url.PathEscape(n)
+		}
+		u = strings.TrimSuffix(u, "/") + "/" + strings.Join(escaped, "/")
+	}
+
+	req, err := ws.client.newRequest(ctx, u)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1))
+
+	res, err := ws.client.seedClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+	case res.StatusCode == http.StatusOK && off == 0:
+		// The server ignored the range, the file starts with what we want
+	default:
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+
+	return ws.read(ctx, res.Body, b)
+}
+
+// fetchHTTPSeed reads the piece at idx from an HTTP seed (BEP 17).
+func (ws *webSeed) fetchHTTPSeed(ctx context.Context, idx uint32, b []byte) error {
+	params := url.Values{}
+	params.Add("info_hash", string(ws.infoHash[:]))
+	params.Add("piece", fmt.Sprint(idx))
+
+	sep := "?"
+	if strings.Contains(ws.url, "?") {
+		sep = "&"
+	}
+
+	req, err := ws.client.newRequest(ctx, ws.url+sep+params.Encode())
+	if err != nil {
+		return err
+	}
+
+	res, err := ws.client.seedClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		// The body holds the number of seconds to wait, some seeds send a
+		// Retry-After header instead
+		retry := res.Header.Get("Retry-After")
+		if retry == "" {
+			body, _ := io.ReadAll(io.LimitReader(res.Body, 32))
+			retry = string(body)
+		}
+		secs, err := strconv.Atoi(strings.TrimSpace(retry))
+		if err != nil || secs <= 0 {
+			secs = int(webSeedMinBackoff / time.Second)
+		}
+		return errSeedBusy{retryAfter: time.Duration(secs) * time.Second}
+	default:
+		return fmt.Errorf("GET %s: %s", ws.url, res.Status)
+	}
+
+	return ws.read(ctx, res.Body, b)
+}
+
+func (ws *webSeed) read(ctx context.Context, r io.Reader, b []byte) error {
+	n, err := io.ReadFull(&limitedReader{Reader: r, down: ws.down, ctx: ctx}, b)
+	ws.stats.addDownloaded(n)
+	return err
+}
@@ -0,0 +1,237 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPieceLength = 16 << 10
+
+// writeRandom fills the file at path with n random bytes.
+func writeRandom(t *testing.T, path string, n int) {
+	t.Helper()
+
+	b := make([]byte, n)
+	rand.Read(b)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestTorrent creates a torrent of the content at path, downloading to a
+// new directory.
+func newTestTorrent(t *testing.T, path string) *Torrent {
+	t.Helper()
+
+	td, err := CreateTorrent(path, CreateOptions{PieceLength: testPieceLength})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tor := newTorrent(&Client{}, td, t.TempDir(), nil)
+	if err := tor.prepareStorage(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tor.storage.close() })
+
+	return tor
+}
+
+func newTestWebSeed(tor *Torrent, u string, httpSeed bool) *webSeed {
+	return &webSeed{
+		url:      u,
+		client:   tor.client,
+		httpSeed: httpSeed,
+		infoHash: tor.infoHash,
+		pieceLen: tor.data.Info.PieceLength,
+		pm:       tor.pm,
+		storage:  tor.storage,
+		stats:    tor.newPeerStats(u, false),
+		log:      tor.log,
+	}
+}
+
+// runWebSeed runs ws until it returns, failing the test if it takes longer
+// than timeout.
+func runWebSeed(t *testing.T, ws *webSeed, timeout time.Duration) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ws.run(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("web seed didn't return in time")
+	}
+}
+
+// checkDownloaded fails the test unless every piece of tor was downloaded
+// and the files under tor's directory match those under src.
+func checkDownloaded(t *testing.T, tor *Torrent, src string, names ...string) {
+	t.Helper()
+
+	if !tor.pm.complete() {
+		t.Fatalf("%d of %d pieces downloaded", tor.pm.DownloadedPieces(), tor.pm.TotalPieces())
+	}
+	if err := tor.storage.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		want, err := os.ReadFile(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(tor.storage.dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the original", name)
+		}
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "file.bin"), 5*testPieceLength+123)
+	tor := newTestTorrent(t, filepath.Join(src, "file.bin"))
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(src)))
+	defer srv.Close()
+
+	runWebSeed(t, newTestWebSeed(tor, srv.URL+"/file.bin", false), 10*time.Second)
+	checkDownloaded(t, tor, src, "file.bin")
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	src := t.TempDir()
+	// Pieces span file boundaries
+	sizes := map[string]int{"a.bin": 10000, "b.bin": 30001, "c.bin": 5000}
+	for name, n := range sizes {
+		writeRandom(t, filepath.Join(src, "bundle", name), n)
+	}
+	tor := newTestTorrent(t, filepath.Join(src, "bundle"))
+
+	var mu sync.Mutex
+	requested := make(map[string]int)
+	files := http.FileServer(http.Dir(src))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested[r.URL.Path]++
+		mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	runWebSeed(t, newTestWebSeed(tor, srv.URL+"/", false), 10*time.Second)
+	checkDownloaded(t, tor, src, "bundle/a.bin", "bundle/b.bin", "bundle/c.bin")
+
+	mu.Lock()
+	defer mu.Unlock()
+	// b.bin is split over pieces 0, 1 and 2
+	if n := requested["/bundle/b.bin"]; n != 3 {
+		t.Errorf("b.bin requested %d times, want 3", n)
+	}
+	for name := range sizes {
+		if requested["/bundle/"+name] == 0 {
+			t.Errorf("%s never requested", name)
+		}
+	}
+}
+
+func TestHTTPSeedBusy(t *testing.T) {
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "file.bin"), 3*testPieceLength+1)
+	tor := newTestTorrent(t, filepath.Join(src, "file.bin"))
+
+	content, err := os.ReadFile(filepath.Join(src, "file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var requests []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		first := len(requests) == 1
+		mu.Unlock()
+
+		if r.URL.Query().Get("info_hash") != string(tor.infoHash[:]) {
+			http.NotFound(w, r)
+			return
+		}
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		idx, err := strconv.Atoi(r.URL.Query().Get("piece"))
+		if err != nil || idx*testPieceLength >= len(content) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content[idx*testPieceLength : min((idx+1)*testPieceLength, len(content))])
+	}))
+	defer srv.Close()
+
+	runWebSeed(t, newTestWebSeed(tor, srv.URL+"/seed", true), 10*time.Second)
+	checkDownloaded(t, tor, src, "file.bin")
+
+	// The seed asked for a second, not the default back-off
+	mu.Lock()
+	defer mu.Unlock()
+	if wait := requests[1].Sub(requests[0]); wait < time.Second || wait >= webSeedMinBackoff {
+		t.Errorf("retried after %s, want 1s", wait)
+	}
+}
+
+func TestWebSeedBadData(t *testing.T) {
+	src := t.TempDir()
+	writeRandom(t, filepath.Join(src, "file.bin"), 3*testPieceLength)
+	tor := newTestTorrent(t, filepath.Join(src, "file.bin"))
+
+	// The server has other content under the same name
+	bad := t.TempDir()
+	writeRandom(t, filepath.Join(bad, "file.bin"), 3*testPieceLength)
+
+	var mu sync.Mutex
+	requests := 0
+	files := http.FileServer(http.Dir(bad))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	// Retrying would take the back-off, returning early means it was dropped
+	runWebSeed(t, newTestWebSeed(tor, srv.URL+"/file.bin", false), webSeedMinBackoff/2)
+
+	if n := tor.pm.DownloadedPieces(); n != 0 {
+		t.Errorf("%d pieces downloaded from a bad seed", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("%d requests, want 1", requests)
+	}
+	if _, ok := tor.pm.nextPiece(func(uint32) bool { return true }); !ok {
+		t.Error("bad piece not put back")
+	}
+}